@@ -0,0 +1,507 @@
+package tx_forge
+
+import (
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/pkg/errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// CoinSelectionPolicy is how SelectCoins chooses txins from the pool
+type CoinSelectionPolicy int
+
+const (
+	// CoinSelectionOptimal looks for a changeless match by branch-and-bound first. If there is none, knapsack and
+	// single random draw select txins with change, the one leaving less change wins
+	CoinSelectionOptimal CoinSelectionPolicy = iota
+	// CoinSelectionLargestFirst takes the biggest coins, so there are the fewest txins
+	CoinSelectionLargestFirst
+	// CoinSelectionOldestFirst takes coins with the lowest UTXO.Height first, unconfirmed ones are the last
+	CoinSelectionOldestFirst
+	// CoinSelectionConsolidate spends as many small coins as fit into a standard tx while FeeRate is not above
+	// Params.ConsolidationFeeRate, it's CoinSelectionOptimal at higher fee rates
+	CoinSelectionConsolidate
+	// CoinSelectionPrivacy never mixes coins of different clusters: the same UTXO.Label, or UTXO.Address if there
+	// is no label, or PubKeyScript if there is neither. The cluster which pays with the least change wins
+	CoinSelectionPrivacy
+)
+
+// DefaultConsolidationFeeRate is the fee rate CoinSelectionConsolidate spends small coins at
+var DefaultConsolidationFeeRate = 5
+
+const (
+	// bnbMaxTries bounds branch-and-bound search, as in Bitcoin Core
+	bnbMaxTries = 100000
+	// knapsackIterations is how many random subsets knapsack tries
+	knapsackIterations = 1000
+
+	// p2wpkhTxOutSize is change output size if it isn't known
+	p2wpkhTxOutSize = 8 + 1 + 22
+	// txOverheadSize is version, locktime, and txins and txouts counts
+	txOverheadSize = 4 + 4 + 1 + 1
+	// maxStandardTxWeight is the biggest tx relayed by nodes
+	maxStandardTxWeight = 400000
+)
+
+// SelectCoins chooses txins from pool to pay for txouts and the fee of params.FeeRate by params.CoinSelection,
+// the result is to pass to ForgeTx. Pool txins have to be spendable by their Unlocker, its Size is what the txin costs.
+// Txins which cost more than they bring are never selected. Without change the rest of txins would be burnt as the fee,
+// so only changeless match will do, whatever the policy is, ErrInvalidParams is returned if there's none
+func SelectCoins(pool []ForgeTxIn, txouts []ForgeTxOut, params *Params) ([]ForgeTxIn, error) {
+	return selectCoins(pool, txouts, params, rand.New(rand.NewSource(time.Now().UnixNano())))
+}
+
+// consolidationFeeRate is Params.ConsolidationFeeRate or DefaultConsolidationFeeRate
+func (p *Params) consolidationFeeRate() int {
+	if p.ConsolidationFeeRate > 0 {
+		return p.ConsolidationFeeRate
+	}
+
+	return DefaultConsolidationFeeRate
+}
+
+// cluster is what identifies owner of UTXO: Label, Address or PubKeyScript, whichever is set first
+func (u *UTXO) cluster() string {
+	if u.Label != "" {
+		return "label:" + u.Label
+	}
+	if u.Address != "" {
+		return "address:" + u.Address
+	}
+
+	return "script:" + string(u.PubKeyScript)
+}
+
+// coin is a pool txin with its value less the fee of spending it
+type coin struct {
+	txin           *ForgeTxIn
+	effectiveValue int
+	weight         int
+}
+
+func selectCoins(pool []ForgeTxIn, txouts []ForgeTxOut, params *Params, rnd *rand.Rand) ([]ForgeTxIn, error) {
+	if len(txouts) == 0 {
+		return nil, errors.Wrap(ErrNoTxInsOrTxOuts, "there are no txouts to select coins for")
+	}
+	if params.FeeRate < 1 {
+		return nil, errors.Wrapf(ErrInvalidFeeRate, "FeeRate %d", params.FeeRate)
+	}
+	if params.Network == nil {
+		return nil, errors.Wrap(ErrInvalidParams, "Network can't be nil")
+	}
+
+	// recipients pay the fee with any strategy but FeeOnTop, then coins cover just txouts
+	feeRate := 0
+	if params.feeStrategy() == FeeOnTop {
+		feeRate = params.FeeRate
+	}
+
+	target := txOverheadSize * feeRate
+	txOutsWeight := 0
+	hasWitness := false
+	for i, txout := range txouts {
+		pkScript, err := txout.locker().LockingScript(params.Network)
+		if err != nil {
+			return nil, errors.Wrapf(err, "txout %d", i)
+		}
+		target += txout.Value + TxOutSize(pkScript)*feeRate
+		txOutsWeight += TxOutSize(pkScript) * 4
+	}
+
+	changeSize := p2wpkhTxOutSize
+	if params.hasChange() {
+		changeTxOut := &ForgeTxOut{Address: params.ChangeAddress, Locker: params.ChangeLocker}
+		pkScript, err := changeTxOut.locker().LockingScript(params.Network)
+		if err != nil {
+			return nil, errors.Wrap(err, "change")
+		}
+		changeSize = TxOutSize(pkScript)
+	}
+	// change costs its output now, and its spending later, the latter is supposed to be P2WPKH one
+	p2wpkhTxInVSize := (txInBaseSize*4 + p2wpkhWitnessSize(nil) + 3) / 4
+	costOfChange := (changeSize + p2wpkhTxInVSize) * params.FeeRate
+
+	// change is there if there is no changeless match, so it's worth not to be dust, which is 3 times its cost at relay fee rate
+	minChange := costOfChange
+	if dustChange := 3 * (changeSize + p2wpkhTxInVSize) * int(mempool.DefaultMinRelayTxFee) / 1000; minChange < dustChange {
+		minChange = dustChange
+	}
+
+	coins := make([]coin, 0, len(pool))
+	available := 0
+	for i := range pool {
+		size := pool[i].unlocker(params.LowR).Size()
+		if size.Witness > 0 {
+			hasWitness = true
+		}
+
+		weight := size.SerializedSize*4 + size.Witness
+		// recipients pay for txins too, so the cost of txin is of params.FeeRate whatever the strategy is
+		if pool[i].Utxo.Value <= (weight+3)/4*params.FeeRate {
+			continue
+		}
+		effectiveValue := pool[i].Utxo.Value - (weight+3)/4*feeRate
+		coins = append(coins, coin{txin: &pool[i], effectiveValue: effectiveValue, weight: weight})
+		available += effectiveValue
+	}
+
+	// segwit marker and flag
+	if hasWitness {
+		target += feeRate
+	}
+
+	if available < target {
+		return nil, errors.WithStack(&ErrInsufficientFunds{Need: target, Have: available})
+	}
+
+	hasChange := params.hasChange()
+	optimal := func(coins []coin) []coin {
+		if !hasChange {
+			return selectCoinsBnB(coins, target, costOfChange)
+		}
+		return selectCoinsOptimal(coins, target, costOfChange, minChange, rnd)
+	}
+
+	var selected []coin
+	switch params.CoinSelection {
+	case CoinSelectionOptimal:
+		selected = optimal(coins)
+
+	case CoinSelectionLargestFirst:
+		if !hasChange {
+			selected = optimal(coins)
+			break
+		}
+		selected = selectCoinsInOrder(coins, target, func(a, b *coin) bool {
+			return a.effectiveValue > b.effectiveValue
+		})
+
+	case CoinSelectionOldestFirst:
+		if !hasChange {
+			selected = optimal(coins)
+			break
+		}
+		selected = selectCoinsInOrder(coins, target, func(a, b *coin) bool {
+			aHeight, bHeight := a.txin.Utxo.Height, b.txin.Utxo.Height
+			if aHeight != bHeight {
+				// unconfirmed ones are the last
+				return bHeight == 0 || aHeight != 0 && aHeight < bHeight
+			}
+			return a.effectiveValue > b.effectiveValue
+		})
+
+	case CoinSelectionConsolidate:
+		if hasChange && params.FeeRate <= params.consolidationFeeRate() {
+			maxTxInsWeight := maxStandardTxWeight - (txOverheadSize+changeSize)*4 - txOutsWeight - 2
+			selected = selectCoinsConsolidation(coins, target, maxTxInsWeight)
+		}
+		if selected == nil {
+			selected = optimal(coins)
+		}
+
+	case CoinSelectionPrivacy:
+		var clusters []string
+		clusterCoins := make(map[string][]coin)
+		for _, c := range coins {
+			cluster := c.txin.Utxo.cluster()
+			if _, ok := clusterCoins[cluster]; !ok {
+				clusters = append(clusters, cluster)
+			}
+			clusterCoins[cluster] = append(clusterCoins[cluster], c)
+		}
+
+		for _, cluster := range clusters {
+			clusterSelected := optimal(clusterCoins[cluster])
+			if clusterSelected != nil && (selected == nil || isBetterSelection(clusterSelected, selected)) {
+				selected = clusterSelected
+			}
+		}
+		if selected == nil && hasChange {
+			// coins aren't mixed for privacy, so funds are of the richest cluster
+			richest := 0
+			for _, coins := range clusterCoins {
+				clusterValue := 0
+				for _, c := range coins {
+					clusterValue += c.effectiveValue
+				}
+				if clusterValue > richest {
+					richest = clusterValue
+				}
+			}
+			return nil, errors.Wrap(&ErrInsufficientFunds{Need: target, Have: richest}, "there is no cluster of coins to pay")
+		}
+
+	default:
+		return nil, errors.Wrapf(ErrInvalidParams, "unknown coin selection policy: %d", params.CoinSelection)
+	}
+
+	if selected == nil && !hasChange {
+		return nil, errors.Wrap(ErrInvalidParams, "there is no changeless match of coins, change is needed")
+	}
+	if selected == nil {
+		return nil, errors.WithStack(&ErrInsufficientFunds{Need: target, Have: available})
+	}
+
+	txins := make([]ForgeTxIn, 0, len(selected))
+	for _, c := range selected {
+		txins = append(txins, *c.txin)
+	}
+
+	return txins, nil
+}
+
+// selectCoinsOptimal is changeless match of branch-and-bound, or knapsack or single random draw one,
+// whichever leaves less change
+func selectCoinsOptimal(coins []coin, target, costOfChange, minChange int, rnd *rand.Rand) []coin {
+	if selected := selectCoinsBnB(coins, target, costOfChange); selected != nil {
+		return selected
+	}
+
+	selected := selectCoinsKnapsack(coins, target, minChange, rnd)
+	if srd := selectCoinsSRD(coins, target+minChange, rnd); srd != nil && (selected == nil || isBetterSelection(srd, selected)) {
+		selected = srd
+	}
+
+	return selected
+}
+
+// selectCoinsInOrder takes coins sorted by less until they cover target
+func selectCoinsInOrder(coins []coin, target int, less func(a, b *coin) bool) []coin {
+	sorted := make([]coin, len(coins))
+	copy(sorted, coins)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(&sorted[i], &sorted[j])
+	})
+
+	value := 0
+	for i, c := range sorted {
+		value += c.effectiveValue
+		if value >= target {
+			return sorted[:i+1]
+		}
+	}
+
+	return nil
+}
+
+// selectCoinsConsolidation takes the smallest coins while they fit into maxWeight, nil if they don't cover target
+func selectCoinsConsolidation(coins []coin, target, maxWeight int) []coin {
+	sorted := make([]coin, len(coins))
+	copy(sorted, coins)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].effectiveValue < sorted[j].effectiveValue
+	})
+
+	var selected []coin
+	value, weight := 0, 0
+	for _, c := range sorted {
+		if weight+c.weight > maxWeight {
+			break
+		}
+		selected = append(selected, c)
+		value += c.effectiveValue
+		weight += c.weight
+	}
+
+	if value < target {
+		return nil
+	}
+
+	return selected
+}
+
+// selectCoinsBnB is depth-first search of coins summing to [target, target+costOfChange], the least excess wins.
+// Coins are tried from the biggest ones, nil if there is no match within bnbMaxTries
+func selectCoinsBnB(coins []coin, target, costOfChange int) []coin {
+	sorted := make([]coin, len(coins))
+	copy(sorted, coins)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].effectiveValue > sorted[j].effectiveValue
+	})
+
+	available := 0
+	for _, c := range sorted {
+		available += c.effectiveValue
+	}
+
+	var selection, bestSelection []int
+	value := 0
+	bestExcess := -1
+	for try, idx := 0, 0; try < bnbMaxTries; try, idx = try+1, idx+1 {
+		backtrack := false
+		switch {
+		case value+available < target || value > target+costOfChange:
+			backtrack = true
+		case value >= target:
+			if excess := value - target; bestExcess < 0 || excess < bestExcess {
+				bestExcess = excess
+				bestSelection = append(bestSelection[:0], selection...)
+			}
+			backtrack = true
+		}
+
+		if backtrack {
+			if len(selection) == 0 {
+				break
+			}
+
+			// coins after the last included one are available again, and it's omitted now
+			last := selection[len(selection)-1]
+			for idx--; idx > last; idx-- {
+				available += sorted[idx].effectiveValue
+			}
+			value -= sorted[last].effectiveValue
+			selection = selection[:len(selection)-1]
+			continue
+		}
+
+		available -= sorted[idx].effectiveValue
+		// omitting coin and including the next equal one is the same branch, it's already searched
+		if len(selection) == 0 || idx-1 == selection[len(selection)-1] || sorted[idx].effectiveValue != sorted[idx-1].effectiveValue {
+			selection = append(selection, idx)
+			value += sorted[idx].effectiveValue
+		}
+	}
+
+	if bestSelection == nil {
+		return nil
+	}
+
+	selected := make([]coin, 0, len(bestSelection))
+	for _, idx := range bestSelection {
+		selected = append(selected, sorted[idx])
+	}
+
+	return selected
+}
+
+// selectCoinsKnapsack is Bitcoin Core knapsack: a coin matching target exactly, or the smallest coin bigger than
+// target+minChange, or random subset of smaller coins closest to target+minChange, whichever is less
+func selectCoinsKnapsack(coins []coin, target, minChange int, rnd *rand.Rand) []coin {
+	shuffled := make([]coin, len(coins))
+	copy(shuffled, coins)
+	rnd.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	var applicable []coin
+	var lowestLarger *coin
+	applicableSum := 0
+	for i, c := range shuffled {
+		switch {
+		case c.effectiveValue == target:
+			return []coin{c}
+		case c.effectiveValue < target+minChange:
+			applicable = append(applicable, c)
+			applicableSum += c.effectiveValue
+		case lowestLarger == nil || c.effectiveValue < lowestLarger.effectiveValue:
+			lowestLarger = &shuffled[i]
+		}
+	}
+
+	if applicableSum == target {
+		return applicable
+	}
+	if applicableSum < target {
+		if lowestLarger == nil {
+			return nil
+		}
+		return []coin{*lowestLarger}
+	}
+
+	sort.SliceStable(applicable, func(i, j int) bool {
+		return applicable[i].effectiveValue > applicable[j].effectiveValue
+	})
+
+	best, bestValue := approximateBestSubset(applicable, applicableSum, target, rnd)
+	if bestValue != target && applicableSum >= target+minChange {
+		best, bestValue = approximateBestSubset(applicable, applicableSum, target+minChange, rnd)
+	}
+
+	// the single larger coin is better if subset doesn't hit target exactly and isn't less than it
+	if lowestLarger != nil && ((bestValue != target && bestValue < target+minChange) || lowestLarger.effectiveValue <= bestValue) {
+		return []coin{*lowestLarger}
+	}
+
+	selected := make([]coin, 0, len(applicable))
+	for i, c := range applicable {
+		if best[i] {
+			selected = append(selected, c)
+		}
+	}
+
+	return selected
+}
+
+// approximateBestSubset is random subset of coins with the least sum not less than target
+func approximateBestSubset(coins []coin, total, target int, rnd *rand.Rand) ([]bool, int) {
+	best := make([]bool, len(coins))
+	for i := range best {
+		best[i] = true
+	}
+	bestValue := total
+
+	included := make([]bool, len(coins))
+	for rep := 0; rep < knapsackIterations && bestValue != target; rep++ {
+		for i := range included {
+			included[i] = false
+		}
+		value := 0
+		reachedTarget := false
+
+		// the first pass includes random coins, the second one includes the rest in order
+		for pass := 0; pass < 2 && !reachedTarget; pass++ {
+			for i, c := range coins {
+				if pass == 0 && rnd.Intn(2) == 0 || pass == 1 && included[i] {
+					continue
+				}
+
+				value += c.effectiveValue
+				included[i] = true
+				if value >= target {
+					reachedTarget = true
+					if value < bestValue {
+						bestValue = value
+						copy(best, included)
+					}
+					value -= c.effectiveValue
+					included[i] = false
+				}
+			}
+		}
+	}
+
+	return best, bestValue
+}
+
+// selectCoinsSRD takes random coins until they cover target
+func selectCoinsSRD(coins []coin, target int, rnd *rand.Rand) []coin {
+	value := 0
+	var selected []coin
+	for _, i := range rnd.Perm(len(coins)) {
+		selected = append(selected, coins[i])
+		value += coins[i].effectiveValue
+		if value >= target {
+			return selected
+		}
+	}
+
+	return nil
+}
+
+// isBetterSelection says whether selection a leaves less change than b, or has fewer coins if change is the same
+func isBetterSelection(a, b []coin) bool {
+	var aValue, bValue int
+	for _, c := range a {
+		aValue += c.effectiveValue
+	}
+	for _, c := range b {
+		bValue += c.effectiveValue
+	}
+
+	if aValue != bValue {
+		return aValue < bValue
+	}
+	return len(a) < len(b)
+}
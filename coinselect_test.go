@@ -0,0 +1,462 @@
+package tx_forge
+
+import (
+	"fmt"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+func TestSelectCoins(t *testing.T) {
+	wifPrivateKey1, _, _ := generateTestKeys(t)
+
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, &chaincfg.TestNet3Params)
+
+	// p2wpkh txin costs 68 vbytes, 136 satoshi at DefaultFeeRate
+	const txInFee = 136
+	generatePool := func(values ...int) []ForgeTxIn {
+		pool := make([]ForgeTxIn, 0, len(values))
+		for i, value := range values {
+			prevTxId := fmt.Sprintf("0bd2fd0e9b5629105884fc4c42f77ae48a6a4fb649df6f678cc6bac28e%06x", i)
+			pool = append(pool, generateTxIn(prevTxId, 0, value, pkScriptP2WPKH, wifPrivateKey1))
+		}
+		return pool
+	}
+
+	params := func(feeStrategy FeeStrategy, changeAddress string) *Params {
+		return &Params{
+			FeeRate:       DefaultFeeRate,
+			Network:       &chaincfg.TestNet3Params,
+			NeedToSign:    true,
+			ChangeAddress: changeAddress,
+			FeeStrategy:   feeStrategy,
+		}
+	}
+
+	// 70000 to p2sh, plus overhead, txout and segwit marker fee
+	const target = 70000 + (10+32+1)*2
+
+	testcases := []struct {
+		name   string
+		pool   []ForgeTxIn
+		params *Params
+
+		wantValues []int // nil if any selection will do
+		wantChange bool
+		wantErr    bool
+	}{
+		{
+			name:       "ok, changeless match",
+			pool:       generatePool(50000+txInFee, 100000+txInFee, 40000+txInFee, 30000+txInFee, target-40000+txInFee),
+			params:     params(FeeOnTop, p2sh2),
+			wantValues: []int{40000 + txInFee, target - 40000 + txInFee},
+		},
+		{
+			name:       "ok, changeless match, recipient pays the fee",
+			pool:       generatePool(50000, 100000, 70000, 30000),
+			params:     params(FeeAuto, ""),
+			wantValues: []int{70000},
+		},
+		{
+			name:       "ok, the smallest coin bigger than target with change",
+			pool:       generatePool(300000, 100000, 200000),
+			params:     params(FeeOnTop, p2sh2),
+			wantValues: []int{100000},
+			wantChange: true,
+		},
+		{
+			name:       "ok, coins which cost more than they bring are skipped",
+			pool:       generatePool(txInFee, txInFee-1, 100000),
+			params:     params(FeeOnTop, p2sh2),
+			wantValues: []int{100000},
+			wantChange: true,
+		},
+		{
+			name:       "ok, coins which cost more than they bring are skipped, recipient pays the fee",
+			pool:       generatePool(txInFee, 70000-txInFee, 70100),
+			params:     params(FeeAuto, ""),
+			wantValues: []int{70100},
+		},
+		{
+			name:       "ok, a few small coins with change",
+			pool:       generatePool(20000, 20000, 20000, 20000, 20000, 20000, 20000, 20000),
+			params:     params(FeeOnTop, p2sh2),
+			wantChange: true,
+		},
+		{
+			name:    "error, insufficient funds",
+			pool:    generatePool(30000, 40000),
+			params:  params(FeeOnTop, p2sh2),
+			wantErr: true,
+		},
+		{
+			name:    "error, no changeless match without change",
+			pool:    generatePool(1000000),
+			params:  params(FeeAuto, ""),
+			wantErr: true,
+		},
+		{
+			name:    "error, empty pool",
+			params:  params(FeeOnTop, p2sh2),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txOuts := []ForgeTxOut{{Value: 70000, Address: p2sh1}}
+
+			txIns, err := selectCoins(tc.pool, txOuts, tc.params, rand.New(rand.NewSource(1)))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if tc.wantValues != nil {
+				values := make([]int, 0, len(txIns))
+				for _, txIn := range txIns {
+					values = append(values, txIn.Utxo.Value)
+				}
+				assert.ElementsMatch(t, tc.wantValues, values)
+			}
+
+			// selection is enough to forge tx
+			redeemTx, sumResult, err := ForgeTx(txIns, txOuts, tc.params)
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, sumResult.Fee, vSize(redeemTx)*DefaultFeeRate)
+			if tc.wantChange {
+				assert.Greater(t, sumResult.Change, 0)
+			} else {
+				assert.Equal(t, 0, sumResult.Change)
+				assert.Len(t, redeemTx.TxOut, len(txOuts))
+			}
+		})
+	}
+
+	t.Run("error, the rest of coins isn't burnt without change", func(t *testing.T) {
+		txOuts := []ForgeTxOut{{Value: 10000, Address: p2sh1}}
+		for _, policy := range []CoinSelectionPolicy{CoinSelectionOptimal, CoinSelectionLargestFirst, CoinSelectionOldestFirst, CoinSelectionConsolidate, CoinSelectionPrivacy} {
+			params := &Params{FeeRate: DefaultFeeRate, Network: &chaincfg.TestNet3Params, CoinSelection: policy}
+			_, err := SelectCoins(generatePool(1000000), txOuts, params)
+			require.ErrorIs(t, err, ErrInvalidParams)
+		}
+	})
+
+	t.Run("ok, thousands of coins", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		values := make([]int, 0, 5000)
+		for i := 0; i < cap(values); i++ {
+			values = append(values, 1000+rnd.Intn(100000))
+		}
+		pool := generatePool(values...)
+		txOuts := []ForgeTxOut{{Value: 1234567, Address: p2sh1}}
+
+		txIns, err := selectCoins(pool, txOuts, params(FeeOnTop, p2sh2), rnd)
+		require.NoError(t, err)
+
+		_, _, err = ForgeTx(txIns, txOuts, params(FeeOnTop, p2sh2))
+		require.NoError(t, err)
+	})
+}
+
+func TestSelectCoinsPolicies(t *testing.T) {
+	wifPrivateKey1, _, _ := generateTestKeys(t)
+
+	addrP2WPKH, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(wifPrivateKey1.SerializePubKey()), &chaincfg.TestNet3Params)
+	require.NoError(t, err)
+	pkScriptP2WPKH := payToAddrOf(t)(addrP2WPKH, nil)
+
+	type utxo struct {
+		value   int
+		height  int
+		address string
+		label   string
+	}
+	generatePool := func(utxos ...utxo) []ForgeTxIn {
+		pool := make([]ForgeTxIn, 0, len(utxos))
+		for i, u := range utxos {
+			prevTxId := fmt.Sprintf("0bd2fd0e9b5629105884fc4c42f77ae48a6a4fb649df6f678cc6bac28e%06x", i)
+			txIn := generateTxIn(prevTxId, 0, u.value, pkScriptP2WPKH, wifPrivateKey1)
+			txIn.Utxo.Height = u.height
+			txIn.Utxo.Address = u.address
+			txIn.Utxo.Label = u.label
+			pool = append(pool, txIn)
+		}
+		return pool
+	}
+	smallCoins := make([]utxo, 0, 11)
+	for i := 0; i < 10; i++ {
+		smallCoins = append(smallCoins, utxo{value: 10000})
+	}
+	smallCoins = append(smallCoins, utxo{value: 100000})
+
+	testcases := []struct {
+		name     string
+		pool     []ForgeTxIn
+		txOut    int
+		policy   CoinSelectionPolicy
+		feeRate  int
+		wantErr  bool
+		wantLen  int   // 0 if wantValues are checked
+		wantVals []int // nil if just wantLen is checked
+
+		// wantOptimal is selection of CoinSelectionOptimal, neither wantLen nor wantVals is checked
+		wantOptimal bool
+	}{
+		{
+			name:     "largest first",
+			pool:     generatePool(utxo{value: 10000}, utxo{value: 50000}, utxo{value: 20000}, utxo{value: 80000}),
+			txOut:    100000,
+			policy:   CoinSelectionLargestFirst,
+			wantVals: []int{80000, 50000},
+		},
+		{
+			name: "oldest first, unconfirmed are the last",
+			pool: generatePool(
+				utxo{value: 50000, height: 0},
+				utxo{value: 30000, height: 300},
+				utxo{value: 40000, height: 100},
+				utxo{value: 60000, height: 200},
+			),
+			txOut:    65000,
+			policy:   CoinSelectionOldestFirst,
+			wantVals: []int{40000, 60000},
+		},
+		{
+			name:    "consolidation at low fee rate spends all small coins",
+			pool:    generatePool(smallCoins...),
+			txOut:   50000,
+			policy:  CoinSelectionConsolidate,
+			feeRate: DefaultConsolidationFeeRate,
+			wantLen: len(smallCoins),
+		},
+		{
+			name:        "consolidation at high fee rate is optimal selection",
+			pool:        generatePool(smallCoins...),
+			txOut:       50000,
+			policy:      CoinSelectionConsolidate,
+			feeRate:     DefaultConsolidationFeeRate + 1,
+			wantOptimal: true,
+		},
+		{
+			name: "privacy, cluster with the least change",
+			pool: generatePool(
+				utxo{value: 30000, label: "alice"},
+				utxo{value: 50000, address: addrP2WPKH.EncodeAddress()},
+				utxo{value: 30000, label: "alice"},
+				utxo{value: 100000},
+				utxo{value: 40000, address: addrP2WPKH.EncodeAddress()},
+			),
+			txOut:    60000,
+			policy:   CoinSelectionPrivacy,
+			wantVals: []int{50000, 40000},
+		},
+		{
+			name: "error, privacy, clusters aren't mixed",
+			pool: generatePool(
+				utxo{value: 40000, label: "alice"},
+				utxo{value: 40000, label: "bob"},
+			),
+			txOut:   60000,
+			policy:  CoinSelectionPrivacy,
+			wantErr: true,
+		},
+		{
+			name:    "error, unknown policy",
+			pool:    generatePool(utxo{value: 100000}),
+			txOut:   60000,
+			policy:  CoinSelectionPrivacy + 1,
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := &Params{
+				FeeRate:       DefaultFeeRate,
+				Network:       &chaincfg.TestNet3Params,
+				NeedToSign:    true,
+				ChangeAddress: p2sh2,
+				CoinSelection: tc.policy,
+			}
+			if tc.feeRate > 0 {
+				params.FeeRate = tc.feeRate
+			}
+			txOuts := []ForgeTxOut{{Value: tc.txOut, Address: p2sh1}}
+
+			txIns, err := selectCoins(tc.pool, txOuts, params, rand.New(rand.NewSource(1)))
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			switch {
+			case tc.wantOptimal:
+				optimalParams := *params
+				optimalParams.CoinSelection = CoinSelectionOptimal
+				optimalTxIns, err := selectCoins(tc.pool, txOuts, &optimalParams, rand.New(rand.NewSource(1)))
+				require.NoError(t, err)
+				assert.Equal(t, optimalTxIns, txIns)
+				assert.Less(t, len(txIns), len(tc.pool))
+			case tc.wantVals != nil:
+				values := make([]int, 0, len(txIns))
+				for _, txIn := range txIns {
+					values = append(values, txIn.Utxo.Value)
+				}
+				assert.ElementsMatch(t, tc.wantVals, values)
+			default:
+				assert.Len(t, txIns, tc.wantLen)
+			}
+
+			_, _, err = ForgeTx(txIns, txOuts, params)
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSelectCoinsAlgorithms(t *testing.T) {
+	coins := func(effectiveValues ...int) []coin {
+		result := make([]coin, 0, len(effectiveValues))
+		for _, effectiveValue := range effectiveValues {
+			result = append(result, coin{txin: &ForgeTxIn{}, effectiveValue: effectiveValue})
+		}
+		return result
+	}
+	values := func(selected []coin) []int {
+		result := make([]int, 0, len(selected))
+		for _, c := range selected {
+			result = append(result, c.effectiveValue)
+		}
+		return result
+	}
+
+	t.Run("branch-and-bound", func(t *testing.T) {
+		testcases := []struct {
+			name         string
+			coins        []coin
+			target       int
+			costOfChange int
+
+			wantValues []int // nil if there is no match
+		}{
+			{
+				name:       "exact match",
+				coins:      coins(1, 2, 3, 4, 5),
+				target:     10,
+				wantValues: []int{5, 4, 1},
+			},
+			{
+				name:         "match within cost of change, the least excess",
+				coins:        coins(100, 60, 45),
+				target:       101,
+				costOfChange: 10,
+				wantValues:   []int{60, 45},
+			},
+			{
+				name:         "equal coins",
+				coins:        coins(7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7),
+				target:       21,
+				costOfChange: 0,
+				wantValues:   []int{7, 7, 7},
+			},
+			{
+				name:         "no match",
+				coins:        coins(100, 200, 300),
+				target:       150,
+				costOfChange: 10,
+			},
+			{
+				name:   "not enough",
+				coins:  coins(1, 2),
+				target: 4,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				selected := selectCoinsBnB(tc.coins, tc.target, tc.costOfChange)
+				if tc.wantValues == nil {
+					assert.Nil(t, selected)
+					return
+				}
+				assert.ElementsMatch(t, tc.wantValues, values(selected))
+			})
+		}
+	})
+
+	t.Run("knapsack", func(t *testing.T) {
+		testcases := []struct {
+			name      string
+			coins     []coin
+			target    int
+			minChange int
+
+			wantValues []int // nil if there is no selection
+		}{
+			{
+				name:       "exact coin",
+				coins:      coins(5, 10, 20),
+				target:     10,
+				minChange:  5,
+				wantValues: []int{10},
+			},
+			{
+				name:       "all smaller coins are exact",
+				coins:      coins(3, 4, 3, 100),
+				target:     10,
+				minChange:  5,
+				wantValues: []int{3, 4, 3},
+			},
+			{
+				name:       "the smallest larger coin, smaller ones aren't enough",
+				coins:      coins(1, 2, 50, 30),
+				target:     20,
+				minChange:  5,
+				wantValues: []int{30},
+			},
+			{
+				name:       "subset with change",
+				coins:      coins(10, 10, 10, 10, 10, 1000),
+				target:     25,
+				minChange:  5,
+				wantValues: []int{10, 10, 10},
+			},
+			{
+				name:      "not enough",
+				coins:     coins(1, 2),
+				target:    4,
+				minChange: 5,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				selected := selectCoinsKnapsack(tc.coins, tc.target, tc.minChange, rand.New(rand.NewSource(1)))
+				if tc.wantValues == nil {
+					assert.Nil(t, selected)
+					return
+				}
+				assert.ElementsMatch(t, tc.wantValues, values(selected))
+			})
+		}
+	})
+
+	t.Run("single random draw", func(t *testing.T) {
+		rnd := rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			selected := selectCoinsSRD(coins(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), 30, rnd)
+			require.NotNil(t, selected)
+
+			sum := 0
+			for _, value := range values(selected) {
+				sum += value
+			}
+			// the last coin is the one reaching target
+			assert.GreaterOrEqual(t, sum, 30)
+			assert.Less(t, sum-selected[len(selected)-1].effectiveValue, 30)
+		}
+
+		assert.Nil(t, selectCoinsSRD(coins(1, 2), 4, rnd))
+	})
+}
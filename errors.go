@@ -0,0 +1,66 @@
+package tx_forge
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// Errors of ForgeTx, ForgePSBT, EstimateTx, SelectCoins, BumpFee and PSBT functions, they come wrapped with details, so check them by errors.Is
+var (
+	// ErrInvalidParams is Params which can't be used, e.g. nil Network or unknown FeeStrategy
+	ErrInvalidParams = errors.New("invalid params")
+	// ErrInvalidFeeRate is Params.FeeRate below 1 sat/vbyte
+	ErrInvalidFeeRate = errors.New("invalid fee rate")
+	// ErrNoTxInsOrTxOuts is tx without txins or txouts
+	ErrNoTxInsOrTxOuts = errors.New("not enough txins or txouts")
+	// ErrAddressNetworkMismatch is address of network other than Params.Network
+	ErrAddressNetworkMismatch = errors.New("address is of another network")
+	// ErrInvalidTxIn is txin which can't be spent as it is, e.g. malformed txId
+	ErrInvalidTxIn = errors.New("invalid txin")
+	// ErrInvalidSigHashType is unknown sighash type, or SIGHASH_SINGLE without txout of the same index
+	ErrInvalidSigHashType = errors.New("invalid sighash type")
+	// ErrInvalidTxOut is txout which can't be paid to, e.g. malformed address or non-standard pkScript
+	ErrInvalidTxOut = errors.New("invalid txout")
+	// ErrTxOutCantPayFee is txout which can't pay the fee, or its share of it, by Params.FeeStrategy
+	ErrTxOutCantPayFee = errors.New("txout can't pay the fee")
+	// ErrNotReplaceable is tx which doesn't signal BIP125 replaceability, so BumpFee can't replace it
+	ErrNotReplaceable = errors.New("tx isn't replaceable")
+	// ErrPSBTConflict is different values of the same field of packets CombinePSBT merges
+	ErrPSBTConflict = errors.New("conflicting PSBT field")
+)
+
+// ErrInsufficientFunds is inputs worth less than txouts, with the fee if it's known
+type ErrInsufficientFunds struct {
+	Need int
+	Have int
+}
+
+func (e *ErrInsufficientFunds) Error() string {
+	return fmt.Sprintf("insufficient funds: %d < %d", e.Have, e.Need)
+}
+
+// Is makes errors.Is(err, &ErrInsufficientFunds{}) true whatever Need and Have are
+func (e *ErrInsufficientFunds) Is(target error) bool {
+	_, ok := target.(*ErrInsufficientFunds)
+	return ok
+}
+
+// ErrInputSignature is txin at Index which isn't signed: signer failed, or signature doesn't satisfy the script
+type ErrInputSignature struct {
+	Index int
+	Err   error
+}
+
+func (e *ErrInputSignature) Error() string {
+	return fmt.Sprintf("txin %d: %v", e.Index, e.Err)
+}
+
+func (e *ErrInputSignature) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, &ErrInputSignature{}) true whatever Index is
+func (e *ErrInputSignature) Is(target error) bool {
+	_, ok := target.(*ErrInputSignature)
+	return ok
+}
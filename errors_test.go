@@ -0,0 +1,180 @@
+package tx_forge
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	testParams := &Params{
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
+	}
+
+	wifPrivateKey1, wifPrivateKey2, _ := generateTestKeys(t)
+
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	regtestAddr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(wifPrivateKey1.SerializePubKey()), &chaincfg.RegressionNetParams)
+	require.NoError(t, err)
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2)
+	p2shMultiSig, err := btcutil.NewAddressScriptHash(multiSigScript, testParams.Network)
+	require.NoError(t, err)
+	pkScriptP2SHMultiSig, err := txscript.PayToAddrScript(p2shMultiSig)
+	require.NoError(t, err)
+
+	txIn := func(value int) ForgeTxIn {
+		return generateTxIn(prevTxId1, 0, value, pkScriptP2WPKH, wifPrivateKey1)
+	}
+
+	testcases := []struct {
+		name    string
+		txIns   []ForgeTxIn
+		txOuts  []ForgeTxOut
+		params  func(params *Params)
+		wantErr error
+	}{
+		{
+			name:    "txouts are worth more than txins",
+			txIns:   []ForgeTxIn{txIn(1000)},
+			txOuts:  []ForgeTxOut{{Value: 2000, Address: p2sh1}},
+			wantErr: &ErrInsufficientFunds{Need: 2000, Have: 1000},
+		},
+		{
+			name:   "txins don't cover the fee",
+			txIns:  []ForgeTxIn{txIn(1000)},
+			txOuts: []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			params: func(params *Params) {
+				params.FeeStrategy = FeeOnTop
+			},
+			wantErr: &ErrInsufficientFunds{Need: 1000 + 110*DefaultFeeRate, Have: 1000},
+		},
+		{
+			name:    "fee rate",
+			txIns:   []ForgeTxIn{txIn(100000)},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			params:  func(params *Params) { params.FeeRate = -1 },
+			wantErr: ErrInvalidFeeRate,
+		},
+		{
+			name:    "fee strategy",
+			txIns:   []ForgeTxIn{txIn(100000)},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			params:  func(params *Params) { params.FeeStrategy = 100 },
+			wantErr: ErrInvalidParams,
+		},
+		{
+			name:    "mainnet bech32 address",
+			txIns:   []ForgeTxIn{txIn(100000)},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: "bc1qar0srrr7xfkvy5l643lydnw9re59gtzzwf5mdq"}},
+			wantErr: ErrAddressNetworkMismatch,
+		},
+		{
+			name:    "regtest address of mainnet tx",
+			txIns:   []ForgeTxIn{txIn(100000)},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: regtestAddr.EncodeAddress()}},
+			params:  func(params *Params) { params.Network = &chaincfg.MainNetParams },
+			wantErr: ErrAddressNetworkMismatch,
+		},
+		{
+			name:    "malformed address",
+			txIns:   []ForgeTxIn{txIn(100000)},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: "2N6SjJNhBgHqvgLZ8Wxc7Yi6jBSGjT9HNPM"}},
+			wantErr: ErrInvalidTxOut,
+		},
+		{
+			name: "malformed txId",
+			txIns: []ForgeTxIn{
+				generateTxIn("0bd2fd0e9b5629105884fc4c42f77ae48a6a4fb649df6f678cc6bac28e39e2ag", 0, 100000, pkScriptP2WPKH, wifPrivateKey1),
+			},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			wantErr: ErrInvalidTxIn,
+		},
+		{
+			name:    "SIGHASH_SINGLE without txout",
+			txIns:   []ForgeTxIn{txIn(100000), {Utxo: UTXO{TxID: prevTxId1, Vout: 1, Value: 1000, PubKeyScript: pkScriptP2WPKH}, WIFPrivKey: wifPrivateKey1, SigHashType: txscript.SigHashSingle}},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			wantErr: ErrInvalidSigHashType,
+		},
+		{
+			name:    "unknown sighash type",
+			txIns:   []ForgeTxIn{{Utxo: UTXO{TxID: prevTxId1, Vout: 0, Value: 100000, PubKeyScript: pkScriptP2WPKH}, WIFPrivKey: wifPrivateKey1, SigHashType: 0x04}},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			wantErr: ErrInvalidSigHashType,
+		},
+		{
+			name:    "unknown sighash type with ANYONECANPAY",
+			txIns:   []ForgeTxIn{{Utxo: UTXO{TxID: prevTxId1, Vout: 0, Value: 100000, PubKeyScript: pkScriptP2WPKH}, WIFPrivKey: wifPrivateKey1, SigHashType: 0x84}},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			wantErr: ErrInvalidSigHashType,
+		},
+		{
+			name:    "fee exceeds txout",
+			txIns:   []ForgeTxIn{txIn(100)},
+			txOuts:  []ForgeTxOut{{Value: 100, Address: p2sh1}},
+			wantErr: ErrTxOutCantPayFee,
+		},
+		{
+			name:    "no txins",
+			txOuts:  []ForgeTxOut{{Value: 100, Address: p2sh1}},
+			wantErr: ErrNoTxInsOrTxOuts,
+		},
+		{
+			name: "key of another input",
+			txIns: []ForgeTxIn{
+				txIn(100000),
+				generateTxIn(prevTxId1, 1, 100000, pkScriptP2WPKH, wifPrivateKey2),
+			},
+			txOuts:  []ForgeTxOut{{Value: 1000, Address: p2sh1}},
+			wantErr: &ErrInputSignature{Index: 1},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			params := *testParams
+			if tc.params != nil {
+				tc.params(&params)
+			}
+
+			_, _, err := ForgeTx(tc.txIns, tc.txOuts, &params)
+			require.ErrorIs(t, err, tc.wantErr)
+
+			switch wantErr := tc.wantErr.(type) {
+			case *ErrInsufficientFunds:
+				var insufficientFunds *ErrInsufficientFunds
+				require.True(t, errors.As(err, &insufficientFunds))
+				assert.Equal(t, wantErr, insufficientFunds)
+			case *ErrInputSignature:
+				var inputSignature *ErrInputSignature
+				require.True(t, errors.As(err, &inputSignature))
+				assert.Equal(t, wantErr.Index, inputSignature.Index)
+			}
+		})
+	}
+
+	t.Run("input signature wraps its cause", func(t *testing.T) {
+		txIn := generateTxIn(prevTxId1, 0, 100000, pkScriptP2SHMultiSig, nil)
+		txIn.RedeemScript = multiSigScript
+		txIn.WIFPrivKeys = []*btcutil.WIF{wifPrivateKey1}
+
+		_, _, err := ForgeTx([]ForgeTxIn{txIn}, []ForgeTxOut{{Value: 1000, Address: p2sh1}}, testParams)
+		assert.ErrorIs(t, err, &ErrInputSignature{})
+		assert.ErrorIs(t, err, errNotEnoughSignatures)
+		assert.Contains(t, err.Error(), "txin 0: ")
+	})
+
+	t.Run("SelectCoins", func(t *testing.T) {
+		_, err := SelectCoins([]ForgeTxIn{txIn(1000)}, []ForgeTxOut{{Value: 5000, Address: p2sh1}}, testParams)
+		assert.ErrorIs(t, err, &ErrInsufficientFunds{})
+
+		params := *testParams
+		params.CoinSelection = 100
+		_, err = SelectCoins([]ForgeTxIn{txIn(100000)}, []ForgeTxOut{{Value: 5000, Address: p2sh1}}, &params)
+		assert.ErrorIs(t, err, ErrInvalidParams)
+	})
+}
@@ -0,0 +1,65 @@
+package tx_forge
+
+import (
+	"github.com/btcsuite/btcd/wire"
+)
+
+// EstimateTx is ForgeSummary of tx ForgeTx would forge, without signing it, so private keys aren't needed.
+// Fee is calculated by worst case sizes of txins, so it may be a few satoshi more than the one of signed tx
+func EstimateTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*ForgeSummary, error) {
+	unsignedParams := *params
+	unsignedParams.NeedToSign = false
+
+	_, summary, err := ForgeTx(txins, txouts, &unsignedParams)
+	if err != nil {
+		return nil, err
+	}
+
+	return summary, nil
+}
+
+// EstimateVSize is the worst case vsize of tx with txins and txouts as they are, once it's signed.
+// Change isn't added, and fee isn't deducted
+func EstimateVSize(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (int, error) {
+	unsignedParams := *params
+	unsignedParams.NeedToSign = false
+
+	redeemTx, _, err := forgeTx(txins, txouts, &unsignedParams)
+	if err != nil {
+		return 0, err
+	}
+
+	return estimateVSize(redeemTx, txins, params), nil
+}
+
+// txVSize is vsize of tx forged by params, unsigned tx is estimated
+func txVSize(tx *wire.MsgTx, txins []ForgeTxIn, params *Params) int {
+	if params.NeedToSign {
+		return vSize(tx)
+	}
+
+	return estimateVSize(tx, txins, params)
+}
+
+// estimateVSize is vsize of unsigned tx after its txins are unlocked, by their Unlocker.Size
+func estimateVSize(tx *wire.MsgTx, txins []ForgeTxIn, params *Params) int {
+	sizeWithoutWitness := tx.SerializeSizeStripped()
+	witnessSize := 0
+	var withoutWitness int
+	for i := range txins {
+		size := txins[i].unlocker(params.LowR).Size()
+
+		sizeWithoutWitness += size.SerializedSize - tx.TxIn[i].SerializeSize()
+		witnessSize += size.Witness
+		if size.Witness == 0 {
+			withoutWitness++
+		}
+	}
+
+	// segwit marker and flag, and empty witness of every txin without one
+	if witnessSize > 0 {
+		witnessSize += 2 + withoutWitness
+	}
+
+	return (sizeWithoutWitness*4 + witnessSize) / 4
+}
@@ -0,0 +1,146 @@
+package tx_forge
+
+import (
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestEstimateTx(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		NeedToSign:    true,
+		ChangeAddress: p2sh2,
+	}
+	prevTxId2 := "0bd2fd0e9b5629105884fc4c42f76ae48a6a4fb649df6f678cc6bac28e39e2ad"
+
+	wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	pkScriptP2PKH := payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey1), testParams.Network))
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	pkScriptP2SH := payToAddr(btcutil.DecodeAddress(p2sh1, testParams.Network))
+	pkScriptP2TR := payToAddr(btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(wifPrivateKey1.PrivKey.PubKey())), testParams.Network))
+
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+	multiSigScriptHash := sha256.Sum256(multiSigScript)
+	pkScriptP2WSH := payToAddr(btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network))
+	pkScriptP2SHMultiSig := payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network))
+
+	multiSigTxIn := func(txId string, pkScript []byte, witnessScript, redeemScript []byte) ForgeTxIn {
+		txIn := generateTxIn(txId, 0, 100000, pkScript, nil)
+		txIn.WitnessScript = witnessScript
+		txIn.RedeemScript = redeemScript
+		txIn.WIFPrivKeys = []*btcutil.WIF{wifPrivateKey1, wifPrivateKey2}
+		return txIn
+	}
+
+	testcases := []struct {
+		name  string
+		txIns []ForgeTxIn
+	}{
+		{
+			name:  "p2pkh",
+			txIns: []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2PKH, wifPrivateKey1)},
+		},
+		{
+			name:  "p2wpkh",
+			txIns: []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, wifPrivateKey1)},
+		},
+		{
+			name:  "p2sh-p2wpkh",
+			txIns: []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2SH, wifPrivateKey1)},
+		},
+		{
+			name:  "p2tr key-path",
+			txIns: []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2TR, wifPrivateKey1)},
+		},
+		{
+			name:  "p2wsh multisig",
+			txIns: []ForgeTxIn{multiSigTxIn(prevTxId1, pkScriptP2WSH, multiSigScript, nil)},
+		},
+		{
+			name:  "p2sh multisig",
+			txIns: []ForgeTxIn{multiSigTxIn(prevTxId1, pkScriptP2SHMultiSig, nil, multiSigScript)},
+		},
+		{
+			name: "legacy and segwit txins",
+			txIns: []ForgeTxIn{
+				generateTxIn(prevTxId1, 0, 100000, pkScriptP2PKH, wifPrivateKey1),
+				generateTxIn(prevTxId2, 0, 100000, pkScriptP2WPKH, wifPrivateKey1),
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txOuts := []ForgeTxOut{{Value: 50000, Address: p2sh1}}
+
+			// keys aren't needed to estimate
+			unsignedTxIns := make([]ForgeTxIn, len(tc.txIns))
+			for i, txIn := range tc.txIns {
+				unsignedTxIns[i] = txIn
+				unsignedTxIns[i].WIFPrivKey = nil
+				unsignedTxIns[i].WIFPrivKeys = nil
+			}
+
+			signedTx, _, err := forgeTx(tc.txIns, txOuts, testParams)
+			require.NoError(t, err)
+
+			estimatedVSize, err := EstimateVSize(unsignedTxIns, txOuts, testParams)
+			require.NoError(t, err)
+
+			// estimation is the worst case, signatures may be a byte shorter, scriptSig length prefix may be shorter with them
+			assert.GreaterOrEqual(t, estimatedVSize, vSize(signedTx))
+			assert.InDelta(t, vSize(signedTx), estimatedVSize, float64(4*len(tc.txIns)))
+
+			redeemTx, sumResult, err := ForgeTx(tc.txIns, txOuts, testParams)
+			require.NoError(t, err)
+
+			estimation, err := EstimateTx(unsignedTxIns, txOuts, testParams)
+			require.NoError(t, err)
+
+			assert.Equal(t, estimation.VSize*testParams.FeeRate, estimation.Fee)
+			assert.GreaterOrEqual(t, estimation.Fee, sumResult.Fee)
+			assert.GreaterOrEqual(t, estimation.VSize, vSize(redeemTx))
+			assert.Equal(t, sumResult.TotalInput, estimation.TotalInput)
+			assert.Equal(t, sumResult.TotalInput, estimation.TotalOutput+estimation.Fee)
+			assert.Equal(t, sumResult.Change+sumResult.Fee, estimation.Change+estimation.Fee)
+		})
+	}
+
+	t.Run("unsigned ForgeTx pays the estimated fee", func(t *testing.T) {
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, nil)}
+		txOuts := []ForgeTxOut{{Value: 50000, Address: p2sh1}}
+
+		unsignedParams := *testParams
+		unsignedParams.NeedToSign = false
+
+		redeemTx, sumResult, err := ForgeTx(txIns, txOuts, &unsignedParams)
+		require.NoError(t, err)
+		assert.Empty(t, redeemTx.TxIn[0].Witness)
+
+		estimation, err := EstimateTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		assert.Equal(t, estimation, sumResult)
+		assert.Greater(t, sumResult.VSize, vSize(redeemTx))
+	})
+
+	t.Run("error, outputs are more than inputs", func(t *testing.T) {
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, nil)}
+		txOuts := []ForgeTxOut{{Value: 100001, Address: p2sh1}}
+
+		_, err := EstimateVSize(txIns, txOuts, testParams)
+		require.Error(t, err)
+
+		_, err = EstimateTx(txIns, txOuts, testParams)
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,199 @@
+package tx_forge
+
+import (
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"math/bits"
+)
+
+// FeeStrategy is who pays the fee: sender on top of txouts, or recipients out of txouts
+type FeeStrategy int
+
+const (
+	// FeeAuto is FeeOnTop if Params has change, otherwise it's deducted from the first txout carrying value
+	FeeAuto FeeStrategy = iota
+	// FeeOnTop is paid by sender, txouts are sent as is
+	FeeOnTop
+	// FeeFromOutput is deducted from txout at Params.FeeOutputIndex
+	FeeFromOutput
+	// FeeSplitProportional is deducted from all txouts in proportion to their values
+	FeeSplitProportional
+	// FeeSplitEvenly is deducted from all txouts in equal parts
+	FeeSplitEvenly
+)
+
+// errDustChange means change can't pay for itself or is below dust threshold, so tx is forged without it
+var errDustChange = errors.New("change is dust")
+
+// feeStrategy resolves FeeAuto
+func (p *Params) feeStrategy() FeeStrategy {
+	if p.FeeStrategy != FeeAuto {
+		return p.FeeStrategy
+	}
+	if p.hasChange() {
+		return FeeOnTop
+	}
+
+	return FeeFromOutput
+}
+
+// forgeTxPayingFee forges tx which pays the fee of its own vsize by params.FeeStrategy, estimated one if tx isn't signed.
+// With changeTxOut the rest of inputs goes to it, and it's the last txout, errDustChange is returned if it's dust
+func forgeTxPayingFee(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params, changeTxOut *ForgeTxOut) (*wire.MsgTx, *ForgeSummary, error) {
+	var inputsSum int
+	for _, txin := range txins {
+		inputsSum += txin.Utxo.Value
+	}
+
+	// the fee is calculated for the final shape, value of change doesn't affect its size
+	shapeTxOuts := txouts[:len(txouts):len(txouts)]
+	if changeTxOut != nil {
+		shapeTxOuts = append(shapeTxOuts, ForgeTxOut{Address: changeTxOut.Address, Locker: changeTxOut.Locker})
+	}
+	redeemTx, _, err := forgeTx(txins, shapeTxOuts, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	calculatedFee := txVSize(redeemTx, txins, params) * params.FeeRate
+
+	// signatures vary in length, and scriptSig length prefix may grow with them, so final tx can be
+	// bigger than the one fee was calculated for, then it's forged again with the fee of the bigger one
+	for {
+		txOutsWithFee, err := applyFeeStrategy(txouts, calculatedFee, params)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		surplus := inputsSum
+		for _, txout := range txOutsWithFee {
+			surplus -= txout.Value
+		}
+
+		if changeTxOut != nil {
+			change := *changeTxOut
+			change.Value = surplus - calculatedFee
+			if change.Value < 0 || isDust(change.Value, redeemTx.TxOut[len(txouts)].PkScript) {
+				return nil, nil, errDustChange
+			}
+			txOutsWithFee = append(txOutsWithFee, change)
+		} else if surplus < calculatedFee {
+			// inputs don't cover txouts and fee
+			return nil, nil, errors.WithStack(&ErrInsufficientFunds{Need: inputsSum - surplus + calculatedFee, Have: inputsSum})
+		}
+
+		redeemTx, summary, err := forgeTx(txins, txOutsWithFee, params)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// recipients can't be left with dust after paying their share
+		for i, txout := range txouts {
+			if txOutsWithFee[i].Value != txout.Value && isDust(txOutsWithFee[i].Value, redeemTx.TxOut[i].PkScript) {
+				return nil, nil, errors.Wrapf(ErrTxOutCantPayFee, "txout %d is dust after paying fee: %d", i, txOutsWithFee[i].Value)
+			}
+		}
+
+		finalVSize := txVSize(redeemTx, txins, params)
+		finalFee := finalVSize * params.FeeRate
+		if summary.Fee >= finalFee {
+			summary.VSize = finalVSize
+			if changeTxOut != nil {
+				summary.Change = txOutsWithFee[len(txouts)].Value
+			}
+			return redeemTx, summary, nil
+		}
+		calculatedFee = finalFee
+	}
+}
+
+// applyFeeStrategy returns copy of txouts with fee deducted from them by params.FeeStrategy.
+// Data outputs have nothing to deduct from, and txout which can't pay its share is an error
+func applyFeeStrategy(txouts []ForgeTxOut, fee int, params *Params) ([]ForgeTxOut, error) {
+	txOutsWithFee := make([]ForgeTxOut, len(txouts), len(txouts)+1)
+	copy(txOutsWithFee, txouts)
+
+	var payers []int
+	var payersSum int
+	for i, txout := range txouts {
+		if txout.Value > 0 {
+			payers = append(payers, i)
+			payersSum += txout.Value
+		}
+	}
+
+	shares := make([]int, len(payers))
+	switch params.feeStrategy() {
+	case FeeOnTop:
+		return txOutsWithFee, nil
+
+	case FeeFromOutput:
+		idx := params.FeeOutputIndex
+		if params.FeeStrategy == FeeAuto && len(payers) > 0 {
+			idx = payers[0]
+		}
+		if idx < 0 || idx >= len(txouts) || txouts[idx].Value == 0 {
+			return nil, errors.Wrapf(ErrTxOutCantPayFee, "txout %d", idx)
+		}
+		txOutsWithFee[idx].Value -= fee
+
+	case FeeSplitProportional:
+		if len(payers) == 0 {
+			return nil, errors.Wrap(ErrTxOutCantPayFee, "there are no txouts to pay the fee")
+		}
+
+		rest := fee
+		for j, i := range payers {
+			// fee * value may overflow, but the share itself fits as value <= payersSum
+			hi, lo := bits.Mul64(uint64(fee), uint64(txouts[i].Value))
+			share, _ := bits.Div64(hi, lo, uint64(payersSum))
+			shares[j] = int(share)
+			rest -= shares[j]
+		}
+		// rounding leftovers are paid by the first txouts, a satoshi each
+		for j := 0; j < rest; j++ {
+			shares[j%len(shares)]++
+		}
+
+	case FeeSplitEvenly:
+		if len(payers) == 0 {
+			return nil, errors.Wrap(ErrTxOutCantPayFee, "there are no txouts to pay the fee")
+		}
+
+		for j := range payers {
+			shares[j] = fee / len(payers)
+			if j < fee%len(payers) {
+				shares[j]++
+			}
+		}
+
+	default:
+		return nil, errors.Wrapf(ErrInvalidParams, "unknown fee strategy: %d", params.FeeStrategy)
+	}
+
+	for j, i := range payers {
+		txOutsWithFee[i].Value -= shares[j]
+	}
+
+	for i, txout := range txOutsWithFee {
+		if txout.Value < 0 {
+			return nil, errors.Wrapf(ErrTxOutCantPayFee, "txout %d is less than its share of fee: %d < %d", i, txouts[i].Value, txouts[i].Value-txout.Value)
+		}
+	}
+
+	return txOutsWithFee, nil
+}
+
+// isDust says whether nodes consider output of value locked by pkScript not worth spending
+func isDust(value int, pkScript []byte) bool {
+	return mempool.IsDust(wire.NewTxOut(int64(value), pkScript), mempool.DefaultMinRelayTxFee)
+}
+
+// vSize is virtual size of tx, witness data is discounted by 4
+func vSize(tx *wire.MsgTx) int {
+	sizeWithWitness := tx.SerializeSize()
+	sizeWithoutWitness := tx.SerializeSizeStripped()
+
+	return (sizeWithoutWitness*3 + sizeWithWitness) / 4
+}
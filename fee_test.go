@@ -0,0 +1,232 @@
+package tx_forge
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestForgeTxFeeStrategy(t *testing.T) {
+	privKey1 := "cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML"
+	p2sh3 := "2N1qk9szETpDxTqcANa3mvcQKtbT4ihyg7C"
+	pkScript1 := "a91490c6addad6abcb929b6edd2833397aed1b5c6f5e87"
+
+	wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+	require.NoError(t, err)
+	pkScriptDecoded1, err := hex.DecodeString(pkScript1)
+	require.NoError(t, err)
+
+	params := func(feeStrategy FeeStrategy, feeOutputIndex int, changeAddress string) *Params {
+		return &Params{
+			FeeRate:        DefaultFeeRate,
+			Network:        &chaincfg.TestNet3Params,
+			NeedToSign:     true,
+			ChangeAddress:  changeAddress,
+			FeeStrategy:    feeStrategy,
+			FeeOutputIndex: feeOutputIndex,
+		}
+	}
+
+	testcases := []struct {
+		name    string
+		balance int
+		outputs []int
+		params  *Params
+
+		// wantPaid are how much of the fee each output paid, nil if outputs pay the fee in some parts
+		wantPaid []int
+		wantErr  bool
+	}{
+		{
+			name:     "ok, auto without change is from the first output",
+			balance:  60000,
+			outputs:  []int{10000, 20000, 30000},
+			params:   params(FeeAuto, 0, ""),
+			wantPaid: []int{-1, 0, 0},
+		},
+		{
+			name:     "ok, auto with change is on top",
+			balance:  100000,
+			outputs:  []int{10000, 20000, 30000},
+			params:   params(FeeAuto, 0, p2sh1),
+			wantPaid: []int{0, 0, 0},
+		},
+		{
+			name:     "ok, on top without change",
+			balance:  61000,
+			outputs:  []int{10000, 20000, 30000},
+			params:   params(FeeOnTop, 0, ""),
+			wantPaid: []int{0, 0, 0},
+		},
+		{
+			name:     "ok, from the named output",
+			balance:  60000,
+			outputs:  []int{10000, 20000, 30000},
+			params:   params(FeeFromOutput, 2, ""),
+			wantPaid: []int{0, 0, -1},
+		},
+		{
+			name:     "ok, from the named output with change",
+			balance:  100000,
+			outputs:  []int{10000, 20000, 30000},
+			params:   params(FeeFromOutput, 1, p2sh1),
+			wantPaid: []int{0, -1, 0},
+		},
+		{
+			name:    "ok, split proportionally",
+			balance: 60000,
+			outputs: []int{10000, 20000, 30000},
+			params:  params(FeeSplitProportional, 0, ""),
+		},
+		{
+			name:    "ok, split evenly",
+			balance: 60000,
+			outputs: []int{10000, 20000, 30000},
+			params:  params(FeeSplitEvenly, 0, ""),
+		},
+		{
+			name:    "error, on top without change, inputs don't cover fee",
+			balance: 60000,
+			outputs: []int{10000, 20000, 30000},
+			params:  params(FeeOnTop, 0, ""),
+			wantErr: true,
+		},
+		{
+			name:    "error, named output doesn't exist",
+			balance: 60000,
+			outputs: []int{10000, 20000, 30000},
+			params:  params(FeeFromOutput, 3, ""),
+			wantErr: true,
+		},
+		{
+			name:    "error, output is less than fee, it isn't dropped",
+			balance: 60000,
+			outputs: []int{100, 29900, 30000},
+			params:  params(FeeAuto, 0, ""),
+			wantErr: true,
+		},
+		{
+			name:    "error, output is dust after paying its share",
+			balance: 60000,
+			outputs: []int{600, 29400, 30000},
+			params:  params(FeeSplitEvenly, 0, ""),
+			wantErr: true,
+		},
+		{
+			name:    "error, unknown strategy",
+			balance: 60000,
+			outputs: []int{10000, 20000, 30000},
+			params:  params(FeeSplitEvenly+1, 0, ""),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, tc.balance, pkScriptDecoded1, wifPrivateKey1)}
+			txOuts := make([]ForgeTxOut, 0, len(tc.outputs))
+			for i, output := range tc.outputs {
+				txOuts = append(txOuts, ForgeTxOut{Value: output, Address: []string{p2sh1, p2sh2, p2sh3}[i]})
+			}
+
+			redeemTx, sumResult, err := ForgeTx(txIns, txOuts, tc.params)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// recipients are never dropped
+			require.GreaterOrEqual(t, len(redeemTx.TxOut), len(tc.outputs))
+			assert.GreaterOrEqual(t, sumResult.Fee, vSize(redeemTx)*DefaultFeeRate)
+
+			paid := make([]int, len(tc.outputs))
+			paidSum := 0
+			for i, output := range tc.outputs {
+				paid[i] = output - int(redeemTx.TxOut[i].Value)
+				paidSum += paid[i]
+			}
+
+			if tc.wantPaid != nil {
+				for i, wantPaid := range tc.wantPaid {
+					if wantPaid < 0 {
+						assert.Equal(t, sumResult.Fee-(tc.balance-sumResult.TotalInput), paid[i], "txout %d pays the whole fee", i)
+					} else {
+						assert.Equal(t, wantPaid, paid[i], "txout %d", i)
+					}
+				}
+				return
+			}
+
+			assert.Equal(t, sumResult.Fee, paidSum)
+			for i := range tc.outputs {
+				assert.Greater(t, paid[i], 0, "txout %d pays its share", i)
+			}
+		})
+	}
+}
+
+func TestApplyFeeStrategy(t *testing.T) {
+	testcases := []struct {
+		name     string
+		outputs  []int
+		fee      int
+		strategy FeeStrategy
+
+		wantOutputs []int
+	}{
+		{
+			name:        "evenly, leftovers are paid by the first outputs",
+			outputs:     []int{1000, 1000, 1000},
+			fee:         11,
+			strategy:    FeeSplitEvenly,
+			wantOutputs: []int{996, 996, 997},
+		},
+		{
+			name:        "evenly, data outputs pay nothing",
+			outputs:     []int{1000, 0, 1000},
+			fee:         11,
+			strategy:    FeeSplitEvenly,
+			wantOutputs: []int{994, 0, 995},
+		},
+		{
+			name:        "proportionally",
+			outputs:     []int{1000, 2000, 7000},
+			fee:         100,
+			strategy:    FeeSplitProportional,
+			wantOutputs: []int{990, 1980, 6930},
+		},
+		{
+			name:        "proportionally, leftovers are paid by the first outputs",
+			outputs:     []int{1000, 1000, 1000},
+			fee:         11,
+			strategy:    FeeSplitProportional,
+			wantOutputs: []int{996, 996, 997},
+		},
+		{
+			name:        "proportionally, large values don't overflow",
+			outputs:     []int{2_000_000_000_000_000, 100_000_000_000_000},
+			fee:         21_000_000,
+			strategy:    FeeSplitProportional,
+			wantOutputs: []int{2_000_000_000_000_000 - 20_000_000, 100_000_000_000_000 - 1_000_000},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txOuts := make([]ForgeTxOut, 0, len(tc.outputs))
+			for _, output := range tc.outputs {
+				txOuts = append(txOuts, ForgeTxOut{Value: output})
+			}
+
+			txOutsWithFee, err := applyFeeStrategy(txOuts, tc.fee, &Params{FeeStrategy: tc.strategy})
+			require.NoError(t, err)
+
+			require.Len(t, txOutsWithFee, len(tc.wantOutputs))
+			for i, wantOutput := range tc.wantOutputs {
+				assert.Equal(t, wantOutput, txOutsWithFee[i].Value, "txout %d", i)
+			}
+		})
+	}
+}
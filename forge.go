@@ -1,12 +1,15 @@
 package tx_forge
 
 import (
+	"fmt"
 	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/pkg/errors"
+	"sync"
 )
 
 //// You'll need UTXOs to fund a transaction. Use the `toUTXO` helper to turn
@@ -29,12 +32,12 @@ import (
 //change: { address: '2N6SjJNhBgHqvgLZ8Wxc7Yi6jBSGjT9HNPL' }
 //})
 
-// TxIn: P2SH-P2WPKH, P2SH, P2PKH, P2PK
-// 	 	 in the future: P2WSH, P2WPKH
+// TxIn: <Unlocker interface>, builtin: P2SH-P2WPKH, P2WPKH, P2SH-P2WSH and P2WSH multisig, P2TR (key-path and script-path),
+// 		 P2PKH, P2SH multisig, P2PK
 
-// TxOut: <ConvertibleTo interface>
-//
+// TxOut: <Locker interface>, builtin: any address, OP_RETURN data, raw pkScript
 
+// ForgeTxInSize is size of the input in bytes, SerializedSize is without witness
 type ForgeTxInSize struct {
 	Witness        int
 	SerializedSize int
@@ -45,16 +48,67 @@ type UTXO struct {
 	Vout         uint32 `json:"vout"`         // vout index
 	Value        int    `json:"value"`        // in satoshis
 	PubKeyScript []byte `json:"pubKeyScript"` // decoded from hex
+
+	// optional metadata for coin selection policies
+	Height  int    `json:"height,omitempty"`  // block height of tx, 0 if it's unconfirmed
+	Address string `json:"address,omitempty"` // address of PubKeyScript
+	Label   string `json:"label,omitempty"`   // wallet label, e.g. cluster of addresses of one customer
 }
 
 type ForgeTxIn struct {
 	Utxo       UTXO         `json:"utxo"`
 	WIFPrivKey *btcutil.WIF `json:"wifPrivKey"`
+
+	// WitnessScript is m-of-n CHECKMULTISIG script of P2WSH or P2SH-P2WSH output
+	WitnessScript []byte `json:"witnessScript,omitempty"`
+	// RedeemScript is m-of-n CHECKMULTISIG script of legacy P2SH output
+	RedeemScript []byte `json:"redeemScript,omitempty"`
+	// WIFPrivKeys sign multisig inputs, any m keys of the script in any order
+	WIFPrivKeys []*btcutil.WIF `json:"wifPrivKeys,omitempty"`
+	// Signer signs the input instead of WIFPrivKey, so the private key may stay in KMS, HSM or remote signer
+	Signer Signer `json:"-"`
+	// Signers sign multisig inputs instead of WIFPrivKeys
+	Signers []Signer `json:"-"`
+
+	// TaprootMerkleRoot is a root of the script tree committed to by P2TR output key,
+	// empty for key-only (BIP86) outputs. It's used to tweak the key of Signer or WIFPrivKey on key-path spending
+	TaprootMerkleRoot []byte `json:"taprootMerkleRoot,omitempty"`
+	// TapScript makes P2TR input spent via script-path instead of key-path
+	TapScript *TapScriptSpend `json:"tapScript,omitempty"`
+
+	// Unlocker spends Utxo instead of the builtin one chosen by type of Utxo.PubKeyScript, fields above are ignored then
+	Unlocker Unlocker `json:"-"`
+
+	// Bip32Derivation are origins of keys signing the input, ForgePSBT hands them to signers
+	Bip32Derivation []*psbt.Bip32Derivation `json:"bip32Derivation,omitempty"`
+	// PrevTx is tx of Utxo, ForgePSBT hands it to signers of legacy inputs
+	PrevTx *wire.MsgTx `json:"-"`
+
+	// SigHashType is what signatures of the input commit to: SIGHASH_ALL of ECDSA and SIGHASH_DEFAULT of taproot
+	// if it's 0. SIGHASH_SINGLE needs txout of the same index, SIGHASH_NONE makes a warning
+	SigHashType txscript.SigHashType `json:"sigHashType,omitempty"`
+}
+
+// TapScriptSpend is what is needed to spend P2TR output via one of its tapscript leaves
+type TapScriptSpend struct {
+	LeafScript   []byte `json:"leafScript"`
+	ControlBlock []byte `json:"controlBlock"` // proves LeafScript is committed to by output key
+
+	// Args are witness elements satisfying LeafScript, bottom of the stack first.
+	// If ForgeTxIn.Signer or WIFPrivKey is set, its signature is inserted into Args at SignatureIndex
+	Args           [][]byte `json:"args,omitempty"`
+	SignatureIndex int      `json:"signatureIndex"`
 }
 
 type ForgeTxOut struct {
 	Value   int    `json:"value"`
 	Address string `json:"address"`
+
+	// Locker locks Value instead of paying to Address
+	Locker Locker `json:"-"`
+
+	// Bip32Derivation are origins of keys of the output, ForgePSBT hands them to signers to verify it
+	Bip32Derivation []*psbt.Bip32Derivation `json:"bip32Derivation,omitempty"`
 }
 
 // DefaultFeeRate is minimal reasonable fee rate
@@ -64,66 +118,87 @@ type Params struct {
 	FeeRate    int
 	Network    *chaincfg.Params
 	NeedToSign bool
-}
 
-// ForgeTx is facade to forgeTx with fee calculation
-func ForgeTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*wire.MsgTx, *ForgeSummary, error) {
-	redeemTx, _, err := forgeTx(txins, txouts, params)
-	if err != nil {
-		return nil, nil, err
-	}
+	NonStandardOutputs NonStandardPolicy
 
-	sizeWithWitness := redeemTx.SerializeSize()
-	sizeWithoutWitness := redeemTx.SerializeSizeStripped()
+	// ChangeAddress receives what is left of inputs after txouts and fee.
+	// Change below dust threshold goes to the fee, so does the whole surplus without change
+	ChangeAddress string
+	// ChangeLocker locks the change instead of ChangeAddress
+	ChangeLocker Locker
+	// ChangeBip32Derivation are origins of keys of change output, see ForgeTxOut.Bip32Derivation
+	ChangeBip32Derivation []*psbt.Bip32Derivation
 
-	vSize := (sizeWithoutWitness*3 + sizeWithWitness) / 4
-	calculatedFee := vSize * params.FeeRate
+	// FeeStrategy is who pays the fee, FeeAuto by default
+	FeeStrategy FeeStrategy
+	// FeeOutputIndex is txout paying the fee with FeeFromOutput strategy
+	FeeOutputIndex int
 
-	txOutsWithFee := make([]ForgeTxOut, 0, len(txouts))
+	// CoinSelection is policy of SelectCoins, CoinSelectionOptimal by default
+	CoinSelection CoinSelectionPolicy
+	// ConsolidationFeeRate is the highest fee rate CoinSelectionConsolidate spends small coins at,
+	// DefaultConsolidationFeeRate if it's 0
+	ConsolidationFeeRate int
 
-	// TODO: reverse slice to cut fee from last output, then re-reverse to put a cut output in the end,
-	// 		 now we are handling only case with one output
-	for _, out := range txouts {
-		txOutValue := out.Value - calculatedFee
+	// LowR grinds ECDSA signatures of WIFPrivKey and WIFPrivKeys to 71 bytes, so fee of estimated vsize is exact
+	LowR bool
 
-		// transaction output is gone to the fee
-		if txOutValue < 0 {
-			calculatedFee = calculatedFee - out.Value
-			continue
-		}
-		calculatedFee = 0
+	// RBF signals BIP125 replaceability by sequences of txins, so the tx may be replaced by BumpFee one
+	RBF bool
 
-		txOutsWithFee = append(txOutsWithFee, ForgeTxOut{
-			Value:   txOutValue,
-			Address: out.Address,
-		})
-	}
+	// SignWorkers is how many inputs are signed and verified at once, one by one if it's 0 or 1.
+	// Signers of inputs must be safe for concurrent use if there are more workers
+	SignWorkers int
+}
+
+// hasChange says whether ForgeTx adds change output
+func (p *Params) hasChange() bool {
+	return p.ChangeAddress != "" || p.ChangeLocker != nil
+}
 
-	if len(txOutsWithFee) == 0 {
-		return nil, nil, errors.New("fee is greater than all txouts")
+// ForgeTx is facade to forgeTx with fee calculation
+func ForgeTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*wire.MsgTx, *ForgeSummary, error) {
+	if params.hasChange() {
+		changeTxOut := &ForgeTxOut{
+			Address: params.ChangeAddress,
+			Locker:  params.ChangeLocker,
+		}
+
+		redeemTx, summary, err := forgeTxPayingFee(txins, txouts, params, changeTxOut)
+		if !errors.Is(err, errDustChange) {
+			return redeemTx, summary, err
+		}
+		// the change goes to the fee
 	}
 
-	return forgeTx(txins, txOutsWithFee, params)
+	return forgeTxPayingFee(txins, txouts, params, nil)
 }
 
 type ForgeSummary struct {
 	Fee         int
 	TotalInput  int
 	TotalOutput int
+	// VSize is virtual size of tx the fee is paid for, the worst case one if tx isn't signed
+	VSize int
+
+	// Change is value of change output, the last one, 0 if there is no change
+	Change int
+	// Warnings are about tx issues which are let through by Params, e.g. non-standard outputs
+	Warnings []string
 }
 
 // forgeTx just creates and signs transaction, without fee calculating, what you put - that you get
 // fee, totalInput, totalOutput
 func forgeTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*wire.MsgTx, *ForgeSummary, error) {
 	if len(txins) == 0 || len(txouts) == 0 {
-		return nil, nil, errors.Errorf("has not enough txins or txouts: %d, %d", len(txins), len(txouts))
+		return nil, nil, errors.Wrapf(ErrNoTxInsOrTxOuts, "%d txins, %d txouts", len(txins), len(txouts))
 	}
 
 	if params.FeeRate < 1 {
-		return nil, nil, errors.Errorf("invalid FeeRate: %d", params.FeeRate)
+		return nil, nil, errors.Wrapf(ErrInvalidFeeRate, "FeeRate %d", params.FeeRate)
 	}
 	if params.Network == nil {
-		return nil, nil, errors.Errorf("params.Network can't be nil")
+		return nil, nil, errors.Wrap(ErrInvalidParams, "Network can't be nil")
 	}
 
 	var inputsSum int
@@ -135,28 +210,44 @@ func forgeTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*wire.MsgT
 
 	for _, txin := range txins {
 		inputsSum += txin.Utxo.Value
-		redeemTxIn, err := createTxIn(&txin, outPointsMap, params)
+		redeemTxIn, err := createTxIn(&txin, outPointsMap)
 
 		if err != nil {
 			return nil, nil, err
 		}
+		if params.RBF {
+			redeemTxIn.Sequence = rbfSequence
+		}
 
 		redeemTx.AddTxIn(redeemTxIn)
 		// TODO: add txIn size to txInSum
 	}
 
 	// output validation
-	var outputsSum int
-	for _, txout := range txouts {
-		destinationAddr, err := btcutil.DecodeAddress(txout.Address, params.Network)
+	var outputsSum, nullDataCount int
+	var warnings []string
+	for i, txout := range txouts {
+		// locking script
+		destinationAddrByte, err := txout.locker().LockingScript(params.Network)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, errors.Wrapf(err, "txout %d", i)
 		}
 
-		// locking script
-		destinationAddrByte, err := txscript.PayToAddrScript(destinationAddr)
-		if err != nil {
-			return nil, nil, err
+		if !isStandardPkScript(destinationAddrByte) {
+			if params.NonStandardOutputs != NonStandardWarn {
+				return nil, nil, errors.Wrapf(ErrInvalidTxOut, "txout %d: non-standard pkScript %x", i, destinationAddrByte)
+			}
+			warnings = append(warnings, fmt.Sprintf("txout %d: non-standard pkScript %x, tx won't be relayed by nodes", i, destinationAddrByte))
+		}
+
+		if txscript.GetScriptClass(destinationAddrByte) == txscript.NullDataTy {
+			nullDataCount++
+			if nullDataCount > 1 {
+				return nil, nil, errors.Wrap(ErrInvalidTxOut, "only one OP_RETURN output is allowed")
+			}
+			if txout.Value != 0 {
+				return nil, nil, errors.Wrapf(ErrInvalidTxOut, "OP_RETURN output must have zero value, got %d", txout.Value)
+			}
 		}
 
 		outputsSum += txout.Value
@@ -166,29 +257,22 @@ func forgeTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*wire.MsgT
 	}
 
 	if outputsSum > inputsSum {
-		return nil, nil, errors.Errorf("outputsSum > inputsSum: %d > %d", outputsSum, inputsSum)
+		return nil, nil, errors.WithStack(&ErrInsufficientFunds{Need: outputsSum, Have: inputsSum})
 	}
 
-	if params.NeedToSign {
-		for i, txin := range redeemTx.TxIn {
-			sigHashes := txscript.NewTxSigHashes(redeemTx, outputFetcher)
-
-			witnessSignature, err := txscript.WitnessSignature(redeemTx, sigHashes, i, int64(txins[i].Utxo.Value), txin.SignatureScript[1:], txscript.SigHashAll, txins[i].WIFPrivKey.PrivKey, true)
-			if err != nil {
-				return nil, nil, err
-			}
-			txin.Witness = witnessSignature
-
-			// checking signature by executing lock+unlock script
-			vm, err := txscript.NewEngine(txins[i].Utxo.PubKeyScript, redeemTx, i, txscript.StandardVerifyFlags, nil, sigHashes, int64(txins[i].Utxo.Value), outputFetcher)
-			if err != nil {
-				return nil, nil, err
-			}
+	for i := range txins {
+		sigHashType := txins[i].SigHashType
+		if err := validateSigHashType(sigHashType, i, len(redeemTx.TxOut)); err != nil {
+			return nil, nil, errors.Wrapf(err, "txin %d", i)
+		}
+		if sigHashType&^txscript.SigHashAnyOneCanPay == txscript.SigHashNone {
+			warnings = append(warnings, fmt.Sprintf("txin %d: SIGHASH_NONE signature lets anyone change txouts", i))
+		}
+	}
 
-			err = vm.Execute()
-			if err != nil {
-				return nil, nil, err
-			}
+	if params.NeedToSign {
+		if err := signTx(redeemTx, txins, outputFetcher, params); err != nil {
+			return nil, nil, err
 		}
 	}
 
@@ -197,54 +281,124 @@ func forgeTx(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*wire.MsgT
 			Fee:         inputsSum - outputsSum,
 			TotalInput:  inputsSum,
 			TotalOutput: outputsSum,
+			Warnings:    warnings,
 		},
 		nil
 }
 
-func createTxIn(txin *ForgeTxIn, outPointsMap map[wire.OutPoint]*wire.TxOut, params *Params) (*wire.TxIn, error) {
-	// out point
+// outPoint is the outpoint of txin Utxo
+func (txin *ForgeTxIn) outPoint() (*wire.OutPoint, error) {
 	utxoHash, err := chainhash.NewHashFromStr(txin.Utxo.TxID)
 	if err != nil {
-		return nil, errors.Wrapf(err, "txId: %s", txin.Utxo.TxID)
+		return nil, errors.Wrapf(ErrInvalidTxIn, "txId %s: %v", txin.Utxo.TxID, err)
+	}
+
+	return wire.NewOutPoint(utxoHash, txin.Utxo.Vout), nil
+}
+
+func createTxIn(txin *ForgeTxIn, outPointsMap map[wire.OutPoint]*wire.TxOut) (*wire.TxIn, error) {
+	outPoint, err := txin.outPoint()
+	if err != nil {
+		return nil, err
 	}
 
-	outPoint := wire.NewOutPoint(utxoHash, txin.Utxo.Vout)
 	outPointsMap[*outPoint] = &wire.TxOut{
 		Value:    int64(txin.Utxo.Value),
 		PkScript: txin.Utxo.PubKeyScript,
 	}
 
-	var witnessProgram []byte
+	// scriptSig and witness are filled by Unlocker after all inputs and outputs are in place
+	return wire.NewTxIn(outPoint, nil, nil), nil
+}
 
-	if params.NeedToSign {
-		// redeem script
-		addrPubKey, err := btcutil.NewAddressPubKey(txin.WIFPrivKey.PrivKey.PubKey().SerializeCompressed(), params.Network)
+// signTx fills scriptSig and witness of every redeemTx input by params.SignWorkers, then verifies them.
+// Sighash midstates are computed once, signatures don't commit to scriptSigs and witnesses of other inputs,
+// so inputs are signed independently and set in place of their index after all of them are signed
+func signTx(redeemTx *wire.MsgTx, txins []ForgeTxIn, outputFetcher prevOutputFetcher, params *Params) error {
+	sigHashes := txscript.NewTxSigHashes(redeemTx, outputFetcher)
+
+	signatureScripts := make([][]byte, len(redeemTx.TxIn))
+	witnesses := make([]wire.TxWitness, len(redeemTx.TxIn))
+	err := forEachTxIn(len(redeemTx.TxIn), params.SignWorkers, func(i int) error {
+		signatureScript, witness, err := txins[i].unlocker(params.LowR).Unlock(&UnlockContext{
+			Tx:          redeemTx,
+			Idx:         i,
+			Utxo:        txins[i].Utxo,
+			SigHashes:   sigHashes,
+			SigHashType: txins[i].SigHashType,
+			Network:     params.Network,
+		})
 		if err != nil {
-			return nil, err
+			return &ErrInputSignature{Index: i, Err: err}
 		}
+		signatureScripts[i], witnesses[i] = signatureScript, witness
 
-		p2kh, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(addrPubKey.ScriptAddress()), params.Network)
-		if err != nil {
-			return nil, err
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, txIn := range redeemTx.TxIn {
+		txIn.SignatureScript = signatureScripts[i]
+		txIn.Witness = witnesses[i]
+	}
+
+	return forEachTxIn(len(redeemTx.TxIn), params.SignWorkers, func(i int) error {
+		if err := verifyTxIn(redeemTx, i, outputFetcher(redeemTx.TxIn[i].PreviousOutPoint), sigHashes, outputFetcher); err != nil {
+			return &ErrInputSignature{Index: i, Err: err}
 		}
+		return nil
+	})
+}
 
-		p2wkhAddr, err := btcutil.NewAddressWitnessPubKeyHash(p2kh.ScriptAddress(), params.Network)
-		if err != nil {
-			return nil, err
+// forEachTxIn calls f of input indexes 0..n-1 by at most workers goroutines, one by one if workers < 2.
+// Error is of the lowest index failing, as if inputs were handled one by one
+func forEachTxIn(n, workers int, f func(i int) error) error {
+	if workers < 2 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return err
+			}
 		}
+		return nil
+	}
+
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
 
-		witnessProgram, err = txscript.PayToAddrScript(p2wkhAddr) // it's redeem script for scriptSig
+	for _, err := range errs {
 		if err != nil {
-			return nil, err
+			return err
 		}
-	} else {
-		// just to fill witness script with something
-		witnessProgram = []byte{0, 1, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6, 0, 7, 0, 8, 0, 9, 0, 10}
 	}
 
-	resultTxIn := wire.NewTxIn(outPoint, append([]byte{22}, witnessProgram...), nil)
+	return nil
+}
+
+// verifyTxIn checks signature of tx.TxIn[idx] by executing lock+unlock script
+func verifyTxIn(tx *wire.MsgTx, idx int, prevOut *wire.TxOut, sigHashes *txscript.TxSigHashes, outputFetcher txscript.PrevOutputFetcher) error {
+	vm, err := txscript.NewEngine(prevOut.PkScript, tx, idx, txscript.StandardVerifyFlags, nil, sigHashes, prevOut.Value, outputFetcher)
+	if err != nil {
+		return err
+	}
 
-	return resultTxIn, nil
+	return vm.Execute()
 }
 
 type prevOutputFetcher func(out wire.OutPoint) *wire.TxOut
@@ -1,26 +1,38 @@
 package tx_forge
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"runtime"
 	"testing"
 )
 
+// fixtures of tests: testnet P2SH addresses, p2sh2 is change address, and txId of utxos
+const (
+	p2sh1     = "2N6SjJNhBgHqvgLZ8Wxc7Yi6jBSGjT9HNPL"
+	p2sh2     = "2MypVYXNoecDgiQNBr8LhJXseDAx9wn9Zrq"
+	prevTxId1 = "0bd2fd0e9b5629105884fc4c42f77ae48a6a4fb649df6f678cc6bac28e39e2ad"
+)
+
 func TestForgeTx(t *testing.T) {
 	testParams := &Params{
-		FeeRate: DefaultFeeRate,
-		Network: &chaincfg.TestNet3Params,
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
 	}
 	privKey1 := "cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML"
-	p2sh1 := "2N6SjJNhBgHqvgLZ8Wxc7Yi6jBSGjT9HNPL"
 
 	pkScript1 := "a91490c6addad6abcb929b6edd2833397aed1b5c6f5e87"
-	prevTxId1 := "0bd2fd0e9b5629105884fc4c42f77ae48a6a4fb649df6f678cc6bac28e39e2ad"
 
 	privKey2 := "cNsAQ7t1SFFDvXsLaMZ4xTg9bqK9RZNWnQDHmPGEPpn5QVRgGGXV"
 	//p2sh2 := "2MypVYXNoecDgiQNBr8LhJXseDAx9wn9Zrq"
@@ -58,6 +70,8 @@ func TestForgeTx(t *testing.T) {
 		pkScriptFromPrivKey := GetPkScriptFromWitnessProgram(witnessProgramFromPrivateKey)
 
 		wantSigScript := append([]byte{22}, witnessProgram...)
+		lowRParams := *testParams
+		lowRParams.LowR = true
 
 		testCases := []struct {
 			name        string
@@ -72,7 +86,7 @@ func TestForgeTx(t *testing.T) {
 			wantAmount              int
 			wantFeeAmount           int
 			wantWitnessSignatureLen int
-			wantErr                 bool // TODO: refactor to check specific errors
+			wantErr                 error
 		}{
 			{
 				name:                    "ok",
@@ -85,7 +99,6 @@ func TestForgeTx(t *testing.T) {
 				netParams:               testParams,
 				wantAmount:              49398,
 				wantFeeAmount:           266,
-				wantErr:                 false,
 				wantWitnessSignatureLen: 72,
 			},
 			{
@@ -99,7 +112,6 @@ func TestForgeTx(t *testing.T) {
 				netParams:               testParams,
 				wantAmount:              1000 - 266,
 				wantFeeAmount:           266,
-				wantErr:                 false,
 				wantWitnessSignatureLen: 71,
 			},
 			{
@@ -113,9 +125,21 @@ func TestForgeTx(t *testing.T) {
 				netParams:               testParams,
 				wantAmount:              100_000_000 - 266,
 				wantFeeAmount:           266,
-				wantErr:                 false,
 				wantWitnessSignatureLen: 72,
 			},
+			{
+				name:                    "ok low R",
+				privKey:                 privKey1,
+				destination:             p2sh1,
+				prevTxID:                prevTxId1,
+				pkScript:                pkScript1,
+				balance:                 100_000_000,
+				output:                  100_000_000,
+				netParams:               &lowRParams,
+				wantAmount:              100_000_000 - 266,
+				wantFeeAmount:           266,
+				wantWitnessSignatureLen: 71,
+			},
 			{
 				name:        "error insufficient balance",
 				privKey:     privKey1,
@@ -125,7 +149,7 @@ func TestForgeTx(t *testing.T) {
 				balance:     200,
 				output:      200,
 				netParams:   testParams,
-				wantErr:     true,
+				wantErr:     ErrTxOutCantPayFee,
 			},
 			{
 				name:          "error private key can't unlock the script",
@@ -138,7 +162,7 @@ func TestForgeTx(t *testing.T) {
 				netParams:     testParams,
 				wantAmount:    49398,
 				wantFeeAmount: 266,
-				wantErr:       true,
+				wantErr:       &ErrInputSignature{},
 			},
 			{
 				name:        "error, wrong network",
@@ -154,7 +178,7 @@ func TestForgeTx(t *testing.T) {
 				},
 				wantAmount:              49398,
 				wantFeeAmount:           266,
-				wantErr:                 true,
+				wantErr:                 ErrAddressNetworkMismatch,
 				wantWitnessSignatureLen: 72,
 			},
 			{
@@ -168,7 +192,7 @@ func TestForgeTx(t *testing.T) {
 				netParams:               testParams,
 				wantAmount:              49398,
 				wantFeeAmount:           266,
-				wantErr:                 true,
+				wantErr:                 ErrAddressNetworkMismatch,
 				wantWitnessSignatureLen: 72,
 			},
 			{
@@ -185,7 +209,7 @@ func TestForgeTx(t *testing.T) {
 				},
 				wantAmount:              49398,
 				wantFeeAmount:           266,
-				wantErr:                 true,
+				wantErr:                 ErrInvalidFeeRate,
 				wantWitnessSignatureLen: 72,
 			},
 			{
@@ -202,7 +226,7 @@ func TestForgeTx(t *testing.T) {
 				},
 				wantAmount:              49398,
 				wantFeeAmount:           266,
-				wantErr:                 true,
+				wantErr:                 ErrInvalidParams,
 				wantWitnessSignatureLen: 72,
 			},
 		}
@@ -237,8 +261,8 @@ func TestForgeTx(t *testing.T) {
 				}
 				redeemTx, sumResult, err := ForgeTx(forgeIns, forgeOuts, tc.netParams)
 
-				if tc.wantErr {
-					require.Error(t, err)
+				if tc.wantErr != nil {
+					require.ErrorIs(t, err, tc.wantErr)
 					return
 				}
 
@@ -326,7 +350,7 @@ func TestForgeTx(t *testing.T) {
 
 			wantLeastOutput int
 			wantLeastFee    int
-			wantErr         bool // TODO: refactor to check specific errors
+			wantErr         error
 		}{
 			{
 				name: "ok",
@@ -344,7 +368,6 @@ func TestForgeTx(t *testing.T) {
 				netParams:       testParams,
 				wantLeastOutput: 4000,
 				wantLeastFee:    900, // ~180 is weight of one input p2wpkh-p2sh
-				wantErr:         false,
 			},
 			{
 				name: "ok, all txins have one prev tx, but different vout",
@@ -362,7 +385,6 @@ func TestForgeTx(t *testing.T) {
 				netParams:       testParams,
 				wantLeastOutput: 4000,
 				wantLeastFee:    900, // ~180 is weight of one input p2wpkh-p2sh, + output + tx itself
-				wantErr:         false,
 			},
 			{
 				name: "error, pkscript and privatekey doesn't match",
@@ -380,7 +402,7 @@ func TestForgeTx(t *testing.T) {
 				netParams:       testParams,
 				wantLeastOutput: 4000,
 				wantLeastFee:    900, // ~180 is weight of one input p2wpkh-p2sh
-				wantErr:         true,
+				wantErr:         &ErrInputSignature{},
 			},
 			{
 				name: "error, input isn't sufficient",
@@ -398,7 +420,7 @@ func TestForgeTx(t *testing.T) {
 				netParams:       testParams,
 				wantLeastOutput: 4000,
 				wantLeastFee:    900, // ~180 is weight of one input p2wpkh-p2sh
-				wantErr:         true,
+				wantErr:         &ErrInsufficientFunds{},
 			},
 			{
 				name:  "error, input is empty",
@@ -410,14 +432,14 @@ func TestForgeTx(t *testing.T) {
 				netParams:       testParams,
 				wantLeastOutput: 0,
 				wantLeastFee:    0, // ~180 is weight of one input p2wpkh-p2sh
-				wantErr:         true,
+				wantErr:         ErrNoTxInsOrTxOuts,
 			},
 		}
 		for _, tc := range testcases {
 			t.Run(tc.name, func(t *testing.T) {
 				redeemTx, sumResult, err := ForgeTx(tc.txIns, []ForgeTxOut{tc.txOut}, tc.netParams)
-				if tc.wantErr {
-					require.Error(t, err)
+				if tc.wantErr != nil {
+					require.ErrorIs(t, err, tc.wantErr)
 					return
 				}
 				require.NotNil(t, redeemTx)
@@ -429,6 +451,829 @@ func TestForgeTx(t *testing.T) {
 			})
 		}
 	})
+	t.Run("native p2wpkh", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+
+		p2wpkhAddr1, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(wifPrivateKey1.SerializePubKey()), testParams.Network)
+		require.NoError(t, err)
+		pkScriptNative1, err := txscript.PayToAddrScript(p2wpkhAddr1)
+		require.NoError(t, err)
+
+		pkScriptDecoded1, err := hex.DecodeString(pkScript1)
+		require.NoError(t, err)
+
+		testcases := []struct {
+			name  string
+			txIns []ForgeTxIn
+			txOut ForgeTxOut
+
+			wantSigScripts [][]byte
+			wantErr        bool
+		}{
+			{
+				name: "ok",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptNative1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2wpkhAddr1.EncodeAddress(),
+				},
+				wantSigScripts: [][]byte{nil},
+			},
+			{
+				name: "ok, mixed with p2sh-p2wpkh",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptNative1, wifPrivateKey1),
+					generateTxIn(prevTxId2, 0, 10000, pkScriptDecoded1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   20000,
+					Address: p2sh1,
+				},
+				wantSigScripts: [][]byte{nil, append([]byte{22}, pkScriptNative1...)},
+			},
+			{
+				name: "error, private key can't unlock the script",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptNative1, wifPrivateKey2),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, sumResult, err := ForgeTx(tc.txIns, []ForgeTxOut{tc.txOut}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, len(tc.wantSigScripts))
+				for i, wantSigScript := range tc.wantSigScripts {
+					assert.Equal(t, wantSigScript, redeemTx.TxIn[i].SignatureScript)
+					assert.Len(t, redeemTx.TxIn[i].Witness, 2)
+				}
+
+				vSize := (redeemTx.SerializeSizeStripped()*3 + redeemTx.SerializeSize()) / 4
+				assert.InDelta(t, vSize*testParams.FeeRate, sumResult.Fee, float64(testParams.FeeRate))
+				assert.Equal(t, int64(tc.txOut.Value-sumResult.Fee), redeemTx.TxOut[0].Value)
+			})
+		}
+	})
+	t.Run("p2pkh", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+
+		p2pkhAddr1, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(wifPrivateKey1.SerializePubKey()), testParams.Network)
+		require.NoError(t, err)
+		pkScriptLegacy1, err := txscript.PayToAddrScript(p2pkhAddr1)
+		require.NoError(t, err)
+
+		p2wpkhAddr1, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(wifPrivateKey1.SerializePubKey()), testParams.Network)
+		require.NoError(t, err)
+		pkScriptNative1, err := txscript.PayToAddrScript(p2wpkhAddr1)
+		require.NoError(t, err)
+
+		testcases := []struct {
+			name  string
+			txIns []ForgeTxIn
+			txOut ForgeTxOut
+
+			wantWitnessLens []int
+			wantErr         bool
+		}{
+			{
+				name: "ok",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptLegacy1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2pkhAddr1.EncodeAddress(),
+				},
+				wantWitnessLens: []int{0},
+			},
+			{
+				name: "ok, mixed with native p2wpkh",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptLegacy1, wifPrivateKey1),
+					generateTxIn(prevTxId2, 0, 10000, pkScriptNative1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   20000,
+					Address: p2sh1,
+				},
+				wantWitnessLens: []int{0, 2},
+			},
+			{
+				name: "error, private key can't unlock the script",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptLegacy1, wifPrivateKey2),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, _, err := ForgeTx(tc.txIns, []ForgeTxOut{tc.txOut}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, len(tc.wantWitnessLens))
+				for i, wantWitnessLen := range tc.wantWitnessLens {
+					assert.Len(t, redeemTx.TxIn[i].Witness, wantWitnessLen)
+				}
+
+				// <sig> <compressed pubkey>
+				pushes, err := txscript.PushedData(redeemTx.TxIn[0].SignatureScript)
+				require.NoError(t, err)
+				require.Len(t, pushes, 2)
+				assert.Equal(t, wifPrivateKey1.SerializePubKey(), pushes[1])
+			})
+		}
+	})
+	t.Run("p2pk", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+
+		p2pkAddr1, err := btcutil.NewAddressPubKey(wifPrivateKey1.SerializePubKey(), testParams.Network)
+		require.NoError(t, err)
+		pkScriptBare1, err := txscript.PayToAddrScript(p2pkAddr1)
+		require.NoError(t, err)
+
+		testcases := []struct {
+			name  string
+			txIns []ForgeTxIn
+			txOut ForgeTxOut
+
+			wantErr bool
+		}{
+			{
+				name: "ok",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptBare1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+			},
+			{
+				name: "error, private key can't unlock the script",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptBare1, wifPrivateKey2),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, sumResult, err := ForgeTx(tc.txIns, []ForgeTxOut{tc.txOut}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, 1)
+				assert.Empty(t, redeemTx.TxIn[0].Witness)
+
+				// bare <sig>
+				pushes, err := txscript.PushedData(redeemTx.TxIn[0].SignatureScript)
+				require.NoError(t, err)
+				require.Len(t, pushes, 1)
+
+				assert.InDelta(t, redeemTx.SerializeSize()*testParams.FeeRate, sumResult.Fee, float64(testParams.FeeRate))
+			})
+		}
+	})
+	t.Run("p2tr key-path", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+
+		// BIP86 key-only output
+		outputKey1 := txscript.ComputeTaprootKeyNoScript(wifPrivateKey1.PrivKey.PubKey())
+		p2trAddr1, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey1), testParams.Network)
+		require.NoError(t, err)
+		pkScriptTaproot1, err := txscript.PayToAddrScript(p2trAddr1)
+		require.NoError(t, err)
+
+		// output committing to a script tree
+		tapLeaf := txscript.NewBaseTapLeaf([]byte{txscript.OP_TRUE})
+		merkleRoot := txscript.AssembleTaprootScriptTree(tapLeaf).RootNode.TapHash()
+		outputKeyWithTree := txscript.ComputeTaprootOutputKey(wifPrivateKey1.PrivKey.PubKey(), merkleRoot[:])
+		addrWithTree, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKeyWithTree), testParams.Network)
+		require.NoError(t, err)
+		pkScriptWithTree, err := txscript.PayToAddrScript(addrWithTree)
+		require.NoError(t, err)
+
+		p2wpkhAddr1, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(wifPrivateKey1.SerializePubKey()), testParams.Network)
+		require.NoError(t, err)
+		pkScriptNative1, err := txscript.PayToAddrScript(p2wpkhAddr1)
+		require.NoError(t, err)
+
+		withMerkleRoot := func(txIn ForgeTxIn, merkleRoot []byte) ForgeTxIn {
+			txIn.TaprootMerkleRoot = merkleRoot
+			return txIn
+		}
+
+		testcases := []struct {
+			name  string
+			txIns []ForgeTxIn
+			txOut ForgeTxOut
+
+			wantErr bool
+		}{
+			{
+				name: "ok",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2trAddr1.EncodeAddress(),
+				},
+			},
+			{
+				name: "ok, output commits to script tree",
+				txIns: []ForgeTxIn{
+					withMerkleRoot(generateTxIn(prevTxId1, 0, 10000, pkScriptWithTree, wifPrivateKey1), merkleRoot[:]),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+			},
+			{
+				name: "ok, mixed with p2wpkh",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot1, wifPrivateKey1),
+					generateTxIn(prevTxId2, 0, 10000, pkScriptNative1, wifPrivateKey1),
+					generateTxIn(prevTxId3, 0, 10000, pkScriptTaproot1, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   30000,
+					Address: p2sh1,
+				},
+			},
+			{
+				name: "error, merkle root isn't passed",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptWithTree, wifPrivateKey1),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+				wantErr: true,
+			},
+			{
+				name: "error, private key can't unlock the script",
+				txIns: []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot1, wifPrivateKey2),
+				},
+				txOut: ForgeTxOut{
+					Value:   10000,
+					Address: p2sh1,
+				},
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, _, err := ForgeTx(tc.txIns, []ForgeTxOut{tc.txOut}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, len(tc.txIns))
+				for i, txIn := range tc.txIns {
+					if !txscript.IsPayToTaproot(txIn.Utxo.PubKeyScript) {
+						continue
+					}
+					assert.Empty(t, redeemTx.TxIn[i].SignatureScript)
+					require.Len(t, redeemTx.TxIn[i].Witness, 1)
+					assert.Len(t, redeemTx.TxIn[i].Witness[0], schnorr.SignatureSize)
+				}
+			})
+		}
+	})
+	t.Run("p2tr script-path", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+		wifPrivateKey3, err := btcutil.DecodeWIF(privKey3)
+		require.NoError(t, err)
+
+		// leaf spendable by privKey2 signature
+		checkSigScript, err := txscript.NewScriptBuilder().
+			AddData(schnorr.SerializePubKey(wifPrivateKey2.PrivKey.PubKey())).
+			AddOp(txscript.OP_CHECKSIG).
+			Script()
+		require.NoError(t, err)
+
+		// leaf spendable by preimage only
+		preimage := []byte("txforge")
+		preimageHash := sha256.Sum256(preimage)
+		hashLockScript, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_SHA256).
+			AddData(preimageHash[:]).
+			AddOp(txscript.OP_EQUAL).
+			Script()
+		require.NoError(t, err)
+
+		// internal key is privKey1, so key-path is spendable by it
+		internalKey := wifPrivateKey1.PrivKey.PubKey()
+		scriptTree := txscript.AssembleTaprootScriptTree(txscript.NewBaseTapLeaf(checkSigScript), txscript.NewBaseTapLeaf(hashLockScript))
+		merkleRoot := scriptTree.RootNode.TapHash()
+		outputKey := txscript.ComputeTaprootOutputKey(internalKey, merkleRoot[:])
+		p2trAddr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), testParams.Network)
+		require.NoError(t, err)
+		pkScriptTaproot, err := txscript.PayToAddrScript(p2trAddr)
+		require.NoError(t, err)
+
+		controlBlock := func(leafIdx int) []byte {
+			cb := scriptTree.LeafMerkleProofs[leafIdx].ToControlBlock(internalKey)
+			cbBytes, err := cb.ToBytes()
+			require.NoError(t, err)
+			return cbBytes
+		}
+		checkSigControlBlock := controlBlock(0)
+		hashLockControlBlock := controlBlock(1)
+
+		withTapScript := func(txIn ForgeTxIn, tapScript *TapScriptSpend) ForgeTxIn {
+			txIn.TapScript = tapScript
+			return txIn
+		}
+
+		testcases := []struct {
+			name  string
+			txIns []ForgeTxIn
+
+			wantWitnessLen int
+			wantErr        bool
+		}{
+			{
+				name: "ok, signature leaf",
+				txIns: []ForgeTxIn{
+					withTapScript(generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot, wifPrivateKey2), &TapScriptSpend{
+						LeafScript:   checkSigScript,
+						ControlBlock: checkSigControlBlock,
+					}),
+				},
+				wantWitnessLen: 3,
+			},
+			{
+				name: "ok, hash lock leaf without signature",
+				txIns: []ForgeTxIn{
+					withTapScript(generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot, nil), &TapScriptSpend{
+						LeafScript:   hashLockScript,
+						ControlBlock: hashLockControlBlock,
+						Args:         [][]byte{preimage},
+					}),
+				},
+				wantWitnessLen: 3,
+			},
+			{
+				name: "error, wrong signer of leaf",
+				txIns: []ForgeTxIn{
+					withTapScript(generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot, wifPrivateKey3), &TapScriptSpend{
+						LeafScript:   checkSigScript,
+						ControlBlock: checkSigControlBlock,
+					}),
+				},
+				wantErr: true,
+			},
+			{
+				name: "error, wrong preimage",
+				txIns: []ForgeTxIn{
+					withTapScript(generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot, nil), &TapScriptSpend{
+						LeafScript:   hashLockScript,
+						ControlBlock: hashLockControlBlock,
+						Args:         [][]byte{[]byte("wrong")},
+					}),
+				},
+				wantErr: true,
+			},
+			{
+				name: "error, control block of another leaf",
+				txIns: []ForgeTxIn{
+					withTapScript(generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot, wifPrivateKey2), &TapScriptSpend{
+						LeafScript:   checkSigScript,
+						ControlBlock: hashLockControlBlock,
+					}),
+				},
+				wantErr: true,
+			},
+			{
+				name: "error, signature index out of range",
+				txIns: []ForgeTxIn{
+					withTapScript(generateTxIn(prevTxId1, 0, 10000, pkScriptTaproot, wifPrivateKey2), &TapScriptSpend{
+						LeafScript:     checkSigScript,
+						ControlBlock:   checkSigControlBlock,
+						SignatureIndex: 1,
+					}),
+				},
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, _, err := ForgeTx(tc.txIns, []ForgeTxOut{{Value: 10000, Address: p2sh1}}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, 1)
+				assert.Empty(t, redeemTx.TxIn[0].SignatureScript)
+				require.Len(t, redeemTx.TxIn[0].Witness, tc.wantWitnessLen)
+				assert.Equal(t, tc.txIns[0].TapScript.LeafScript, redeemTx.TxIn[0].Witness[tc.wantWitnessLen-2])
+				assert.Equal(t, tc.txIns[0].TapScript.ControlBlock, redeemTx.TxIn[0].Witness[tc.wantWitnessLen-1])
+			})
+		}
+	})
+	t.Run("p2wsh and p2sh-p2wsh multisig", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+		wifPrivateKey3, err := btcutil.DecodeWIF(privKey3)
+		require.NoError(t, err)
+		wifPrivateKey4, err := btcutil.DecodeWIF(privKey4)
+		require.NoError(t, err)
+
+		// 2-of-3 of privKey1, privKey2, privKey3
+		multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+		multiSigScriptHash := sha256.Sum256(multiSigScript)
+
+		p2wshAddr, err := btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network)
+		require.NoError(t, err)
+		pkScriptP2WSH, err := txscript.PayToAddrScript(p2wshAddr)
+		require.NoError(t, err)
+
+		p2shP2WSHAddr, err := btcutil.NewAddressScriptHash(pkScriptP2WSH, testParams.Network)
+		require.NoError(t, err)
+		pkScriptP2SHP2WSH, err := txscript.PayToAddrScript(p2shP2WSHAddr)
+		require.NoError(t, err)
+
+		multiSigTxIn := func(pkScript []byte, privKeys ...*btcutil.WIF) ForgeTxIn {
+			txIn := generateTxIn(prevTxId1, 0, 10000, pkScript, nil)
+			txIn.WitnessScript = multiSigScript
+			txIn.WIFPrivKeys = privKeys
+			return txIn
+		}
+
+		testcases := []struct {
+			name string
+			txIn ForgeTxIn
+
+			wantSigScript []byte
+			wantErr       bool
+		}{
+			{
+				name: "ok, p2wsh",
+				txIn: multiSigTxIn(pkScriptP2WSH, wifPrivateKey1, wifPrivateKey2),
+			},
+			{
+				name: "ok, p2wsh, keys in reverse order",
+				txIn: multiSigTxIn(pkScriptP2WSH, wifPrivateKey3, wifPrivateKey1),
+			},
+			{
+				name: "ok, p2wsh, more keys than needed",
+				txIn: multiSigTxIn(pkScriptP2WSH, wifPrivateKey4, wifPrivateKey3, wifPrivateKey2, wifPrivateKey1),
+			},
+			{
+				name:          "ok, p2sh-p2wsh",
+				txIn:          multiSigTxIn(pkScriptP2SHP2WSH, wifPrivateKey2, wifPrivateKey3),
+				wantSigScript: append([]byte{34}, pkScriptP2WSH...),
+			},
+			{
+				name:    "error, not enough keys",
+				txIn:    multiSigTxIn(pkScriptP2WSH, wifPrivateKey1),
+				wantErr: true,
+			},
+			{
+				name:    "error, keys aren't in the script",
+				txIn:    multiSigTxIn(pkScriptP2WSH, wifPrivateKey1, wifPrivateKey4),
+				wantErr: true,
+			},
+			{
+				name: "error, witness script doesn't match pkScript",
+				txIn: func() ForgeTxIn {
+					txIn := multiSigTxIn(pkScriptP2WSH, wifPrivateKey1, wifPrivateKey2)
+					txIn.WitnessScript = generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2)
+					return txIn
+				}(),
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, _, err := ForgeTx([]ForgeTxIn{tc.txIn}, []ForgeTxOut{{Value: 10000, Address: p2sh1}}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, 1)
+				assert.Equal(t, tc.wantSigScript, redeemTx.TxIn[0].SignatureScript)
+
+				// <empty> <sig1> <sig2> <witness script>
+				require.Len(t, redeemTx.TxIn[0].Witness, 4)
+				assert.Empty(t, redeemTx.TxIn[0].Witness[0])
+				assert.Equal(t, multiSigScript, redeemTx.TxIn[0].Witness[3])
+			})
+		}
+	})
+	t.Run("p2sh multisig", func(t *testing.T) {
+		wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+		require.NoError(t, err)
+		wifPrivateKey2, err := btcutil.DecodeWIF(privKey2)
+		require.NoError(t, err)
+		wifPrivateKey3, err := btcutil.DecodeWIF(privKey3)
+		require.NoError(t, err)
+		wifPrivateKey4, err := btcutil.DecodeWIF(privKey4)
+		require.NoError(t, err)
+
+		// 2-of-3 of privKey1, privKey2, privKey3
+		multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+		p2shAddr, err := btcutil.NewAddressScriptHash(multiSigScript, testParams.Network)
+		require.NoError(t, err)
+		pkScriptP2SH, err := txscript.PayToAddrScript(p2shAddr)
+		require.NoError(t, err)
+
+		multiSigTxIn := func(privKeys ...*btcutil.WIF) ForgeTxIn {
+			txIn := generateTxIn(prevTxId1, 0, 10000, pkScriptP2SH, nil)
+			txIn.RedeemScript = multiSigScript
+			txIn.WIFPrivKeys = privKeys
+			return txIn
+		}
+
+		testcases := []struct {
+			name string
+			txIn ForgeTxIn
+
+			wantErr bool
+		}{
+			{
+				name: "ok",
+				txIn: multiSigTxIn(wifPrivateKey1, wifPrivateKey2),
+			},
+			{
+				name: "ok, keys in reverse order",
+				txIn: multiSigTxIn(wifPrivateKey3, wifPrivateKey2),
+			},
+			{
+				name:    "error, not enough keys",
+				txIn:    multiSigTxIn(wifPrivateKey2),
+				wantErr: true,
+			},
+			{
+				name:    "error, keys aren't in the script",
+				txIn:    multiSigTxIn(wifPrivateKey4, wifPrivateKey1),
+				wantErr: true,
+			},
+			{
+				name: "error, redeem script doesn't match pkScript",
+				txIn: func() ForgeTxIn {
+					txIn := multiSigTxIn(wifPrivateKey1, wifPrivateKey2)
+					txIn.RedeemScript = generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2)
+					return txIn
+				}(),
+				wantErr: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				redeemTx, sumResult, err := ForgeTx([]ForgeTxIn{tc.txIn}, []ForgeTxOut{{Value: 10000, Address: p2sh1}}, testParams)
+				if tc.wantErr {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				require.NotNil(t, redeemTx)
+
+				require.Len(t, redeemTx.TxIn, 1)
+				assert.Empty(t, redeemTx.TxIn[0].Witness)
+
+				// OP_0 <sig1> <sig2> <redeem script>
+				pushes, err := txscript.PushedData(redeemTx.TxIn[0].SignatureScript)
+				require.NoError(t, err)
+				require.Len(t, pushes, 4)
+				assert.Empty(t, pushes[0])
+				assert.Equal(t, multiSigScript, pushes[3])
+
+				// fee covers the final scriptSig, which may differ from the estimated one by a byte of each signature
+				// and by scriptSig length prefix
+				assert.GreaterOrEqual(t, sumResult.Fee, redeemTx.SerializeSize()*testParams.FeeRate)
+				assert.LessOrEqual(t, sumResult.Fee, (redeemTx.SerializeSize()+4)*testParams.FeeRate)
+			})
+		}
+	})
+}
+
+func TestForgeTxChange(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		NeedToSign:    true,
+		ChangeAddress: p2sh2,
+	}
+	privKey1 := "cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML"
+	pkScript1 := "a91490c6addad6abcb929b6edd2833397aed1b5c6f5e87"
+
+	wifPrivateKey1, err := btcutil.DecodeWIF(privKey1)
+	require.NoError(t, err)
+	pkScriptDecoded1, err := hex.DecodeString(pkScript1)
+	require.NoError(t, err)
+
+	changeAddr, err := btcutil.DecodeAddress(testParams.ChangeAddress, testParams.Network)
+	require.NoError(t, err)
+	changePkScript, err := txscript.PayToAddrScript(changeAddr)
+	require.NoError(t, err)
+	opTruePkScript, err := (&opTrueLocker{}).LockingScript(testParams.Network)
+	require.NoError(t, err)
+
+	withChange := func(changeAddress string, changeLocker Locker) *Params {
+		params := *testParams
+		params.ChangeAddress = changeAddress
+		params.ChangeLocker = changeLocker
+		return &params
+	}
+
+	testcases := []struct {
+		name    string
+		balance int
+		output  int
+		params  *Params
+
+		wantChangePkScript []byte
+		wantFee            int // 0 if fee is just vsize * fee rate
+		wantErr            bool
+	}{
+		{
+			name:               "ok, change",
+			balance:            50000,
+			output:             10000,
+			params:             testParams,
+			wantChangePkScript: changePkScript,
+		},
+		{
+			name:               "ok, change locker",
+			balance:            50000,
+			output:             10000,
+			params:             withChange("", &opTrueLocker{}),
+			wantChangePkScript: opTruePkScript,
+		},
+		{
+			name:    "ok, dust change goes to the fee",
+			balance: 10000,
+			output:  9500,
+			params:  testParams,
+			wantFee: 500,
+		},
+		{
+			name:    "ok, change which can't pay for itself goes to the fee",
+			balance: 10000,
+			output:  9700,
+			params:  testParams,
+			wantFee: 300,
+		},
+		{
+			name:    "error, inputs don't cover fee",
+			balance: 10000,
+			output:  9900,
+			params:  testParams,
+			wantErr: true,
+		},
+		{
+			name:    "error, outputs are greater than inputs",
+			balance: 10000,
+			output:  10001,
+			params:  testParams,
+			wantErr: true,
+		},
+		{
+			name:    "error, change address is for wrong network",
+			balance: 50000,
+			output:  10000,
+			params:  withChange("3CuDaAXPUQJGLpyaZThy12s4APdd2qXK1k", nil),
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, tc.balance, pkScriptDecoded1, wifPrivateKey1)}
+
+			redeemTx, sumResult, err := ForgeTx(txIns, []ForgeTxOut{{Value: tc.output, Address: p2sh1}}, tc.params)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// fee is on top of the output
+			assert.Equal(t, int64(tc.output), redeemTx.TxOut[0].Value)
+			assert.Equal(t, tc.balance, sumResult.TotalInput)
+			assert.Equal(t, sumResult.TotalInput, sumResult.TotalOutput+sumResult.Fee)
+
+			if tc.wantChangePkScript == nil {
+				require.Len(t, redeemTx.TxOut, 1)
+				assert.Zero(t, sumResult.Change)
+				assert.Equal(t, tc.wantFee, sumResult.Fee)
+				return
+			}
+
+			require.Len(t, redeemTx.TxOut, 2)
+			assert.Equal(t, tc.wantChangePkScript, redeemTx.TxOut[1].PkScript)
+			assert.Equal(t, int64(sumResult.Change), redeemTx.TxOut[1].Value)
+
+			// nothing is lost to the fee
+			assert.GreaterOrEqual(t, sumResult.Fee, vSize(redeemTx)*testParams.FeeRate)
+			assert.LessOrEqual(t, sumResult.Fee, (vSize(redeemTx)+1)*testParams.FeeRate)
+		})
+	}
+}
+
+func TestForgeTxSignWorkers(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		NeedToSign:    true,
+		ChangeAddress: p2sh2,
+	}
+
+	wifPrivateKey1, err := btcutil.DecodeWIF("cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML")
+	require.NoError(t, err)
+	txIns := generateMixedTxIns(t, prevTxId1, 30, wifPrivateKey1, testParams.Network)
+	txOuts := []ForgeTxOut{{Value: 100000, Address: p2sh1}}
+
+	wantTx, wantSummary, err := ForgeTx(txIns, txOuts, testParams)
+	require.NoError(t, err)
+
+	for _, workers := range []int{-1, 2, 7, 64} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			params := *testParams
+			params.SignWorkers = workers
+
+			redeemTx, summary, err := ForgeTx(txIns, txOuts, &params)
+			require.NoError(t, err)
+			assert.Equal(t, wantSummary, summary)
+			assert.Equal(t, wantTx, redeemTx)
+		})
+	}
+
+	t.Run("error of the lowest index", func(t *testing.T) {
+		txIns := generateMixedTxIns(t, prevTxId1, 30, wifPrivateKey1, testParams.Network)
+		for _, i := range []int{25, 11, 17} {
+			txIns[i].WIFPrivKey = nil
+			txIns[i].Signer = &remoteSigner{pubKey: wifPrivateKey1.SerializePubKey(), err: errors.New("signing service is unavailable")}
+		}
+		params := *testParams
+		params.SignWorkers = 8
+
+		_, _, err := ForgeTx(txIns, txOuts, &params)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "txin 11:")
+	})
 }
 
 // TestGetPkScriptFromWitnessProgram also tests GetWitnessProgramFromPrivateKey
@@ -530,3 +1375,210 @@ func generateTxIn(txId string, vout uint32, value int, pkScript []byte, wifPriva
 		WIFPrivKey: wifPrivateKey,
 	}
 }
+
+// testTapTree is taproot output of internal key committing to a single leaf of CHECKSIG by leaf key
+type testTapTree struct {
+	LeafScript   []byte
+	MerkleRoot   []byte
+	ControlBlock []byte
+	OutputKey    *btcec.PublicKey
+	PkScript     []byte
+}
+
+// generateTapTree helper for tests
+func generateTapTree(tb testing.TB, internalKey, leafKey *btcutil.WIF, network *chaincfg.Params) *testTapTree {
+	leafScript, err := txscript.NewScriptBuilder().
+		AddData(schnorr.SerializePubKey(leafKey.PrivKey.PubKey())).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	require.NoError(tb, err)
+	scriptTree := txscript.AssembleTaprootScriptTree(txscript.NewBaseTapLeaf(leafScript))
+	merkleRoot := scriptTree.RootNode.TapHash()
+	tapControlBlock := scriptTree.LeafMerkleProofs[0].ToControlBlock(internalKey.PrivKey.PubKey())
+	controlBlock, err := tapControlBlock.ToBytes()
+	require.NoError(tb, err)
+	outputKey := txscript.ComputeTaprootOutputKey(internalKey.PrivKey.PubKey(), merkleRoot[:])
+
+	return &testTapTree{
+		LeafScript:   leafScript,
+		MerkleRoot:   merkleRoot[:],
+		ControlBlock: controlBlock,
+		OutputKey:    outputKey,
+		PkScript:     payToAddrOf(tb)(btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), network)),
+	}
+}
+
+// generateTestKeys helper for tests, the testnet keys of tests
+func generateTestKeys(tb testing.TB) (wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 *btcutil.WIF) {
+	wifPrivateKeys := make([]*btcutil.WIF, 0, 3)
+	for _, privKey := range []string{
+		"cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML",
+		"cNsAQ7t1SFFDvXsLaMZ4xTg9bqK9RZNWnQDHmPGEPpn5QVRgGGXV",
+		"cVUJncM2GPMBnb3TFS8zU4CQ1qHgZLRdEwg3iFyZwds3AL3EK56U",
+	} {
+		wifPrivateKey, err := btcutil.DecodeWIF(privKey)
+		require.NoError(tb, err)
+		wifPrivateKeys = append(wifPrivateKeys, wifPrivateKey)
+	}
+
+	return wifPrivateKeys[0], wifPrivateKeys[1], wifPrivateKeys[2]
+}
+
+// payToAddrOf helper for tests, its func is pkScript of address which is made without error
+func payToAddrOf(tb testing.TB) func(addr btcutil.Address, err error) []byte {
+	return func(addr btcutil.Address, err error) []byte {
+		require.NoError(tb, err)
+		pkScript, err := txscript.PayToAddrScript(addr)
+		require.NoError(tb, err)
+		return pkScript
+	}
+}
+
+// generateP2WPKHPkScript helper for tests
+func generateP2WPKHPkScript(tb testing.TB, wifPrivateKey *btcutil.WIF, network *chaincfg.Params) []byte {
+	return payToAddrOf(tb)(btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(wifPrivateKey.SerializePubKey()), network))
+}
+
+// generateMixedTxIns are n p2pkh, p2wpkh and p2tr inputs of wifPrivateKey, in turn, helper for tests
+func generateMixedTxIns(tb testing.TB, txId string, n int, wifPrivateKey *btcutil.WIF, network *chaincfg.Params) []ForgeTxIn {
+	pubKey := wifPrivateKey.SerializePubKey()
+	p2pkh, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey), network)
+	require.NoError(tb, err)
+	p2wpkh, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pubKey), network)
+	require.NoError(tb, err)
+	p2tr, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootOutputKey(wifPrivateKey.PrivKey.PubKey(), nil)), network)
+	require.NoError(tb, err)
+
+	pkScripts := make([][]byte, 0, 3)
+	for _, addr := range []btcutil.Address{p2pkh, p2wpkh, p2tr} {
+		pkScript, err := txscript.PayToAddrScript(addr)
+		require.NoError(tb, err)
+		pkScripts = append(pkScripts, pkScript)
+	}
+
+	txIns := make([]ForgeTxIn, 0, n)
+	for i := 0; i < n; i++ {
+		txIns = append(txIns, generateTxIn(txId, uint32(i), 10000, pkScripts[i%len(pkScripts)], wifPrivateKey))
+	}
+
+	return txIns
+}
+
+// BenchmarkForgeTx signs consolidations of p2wpkh inputs, and mixed ones, by one and by every CPU.
+// Signing of the unsigned tx with midstates computed once is compared to computing them for every input
+func BenchmarkForgeTx(b *testing.B) {
+	params := &Params{
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
+	}
+	wifPrivateKey1, _, _ := generateTestKeys(b)
+	txOuts := []ForgeTxOut{{Value: 100000, Address: p2sh1}}
+
+	mixed := generateMixedTxIns(b, prevTxId1, 3000, wifPrivateKey1, params.Network)
+	p2wpkh := make([]ForgeTxIn, 0, len(mixed)/3)
+	for i := 1; i < len(mixed); i += 3 {
+		p2wpkh = append(p2wpkh, mixed[i])
+	}
+	mixed = mixed[:500]
+	workersCounts := []int{1}
+	if runtime.NumCPU() > 1 {
+		workersCounts = append(workersCounts, runtime.NumCPU())
+	}
+
+	for _, txIns := range []struct {
+		name  string
+		txIns []ForgeTxIn
+	}{{"p2wpkh", p2wpkh}, {"mixed", mixed}} {
+		for _, workers := range workersCounts {
+			b.Run(fmt.Sprintf("%d %s inputs by %d workers", len(txIns.txIns), txIns.name, workers), func(b *testing.B) {
+				params := *params
+				params.SignWorkers = workers
+				for i := 0; i < b.N; i++ {
+					if _, _, err := forgeTx(txIns.txIns, txOuts, &params); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+
+		unsignedParams := *params
+		unsignedParams.NeedToSign = false
+		redeemTx, _, err := forgeTx(txIns.txIns, txOuts, &unsignedParams)
+		require.NoError(b, err)
+		outputFetcher := generateOutputFetcher(b, txIns.txIns)
+
+		b.Run(fmt.Sprintf("%d %s inputs, sighashes once", len(txIns.txIns), txIns.name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := signTx(redeemTx, txIns.txIns, outputFetcher, params); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d %s inputs, sighashes per input", len(txIns.txIns), txIns.name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := signTxSigHashesPerInput(redeemTx, txIns.txIns, outputFetcher, params); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// generateOutputFetcher helper for tests, fetches utxos of txins
+func generateOutputFetcher(tb testing.TB, txins []ForgeTxIn) prevOutputFetcher {
+	outPointsMap := make(map[wire.OutPoint]*wire.TxOut, len(txins))
+	for _, txin := range txins {
+		outPoint, err := txin.outPoint()
+		require.NoError(tb, err)
+		outPointsMap[*outPoint] = wire.NewTxOut(int64(txin.Utxo.Value), txin.Utxo.PubKeyScript)
+	}
+
+	return func(out wire.OutPoint) *wire.TxOut {
+		return outPointsMap[out]
+	}
+}
+
+// signTxSigHashesPerInput signs redeemTx as signTx did before midstates were cached: sighashes are computed
+// for every input, which hashes all inputs and outputs, so signing is quadratic of the number of inputs
+func signTxSigHashesPerInput(redeemTx *wire.MsgTx, txins []ForgeTxIn, outputFetcher prevOutputFetcher, params *Params) error {
+	for i := range redeemTx.TxIn {
+		sigHashes := txscript.NewTxSigHashes(redeemTx, outputFetcher)
+
+		signatureScript, witness, err := txins[i].unlocker(params.LowR).Unlock(&UnlockContext{
+			Tx:          redeemTx,
+			Idx:         i,
+			Utxo:        txins[i].Utxo,
+			SigHashes:   sigHashes,
+			SigHashType: txins[i].SigHashType,
+			Network:     params.Network,
+		})
+		if err != nil {
+			return &ErrInputSignature{Index: i, Err: err}
+		}
+		redeemTx.TxIn[i].SignatureScript = signatureScript
+		redeemTx.TxIn[i].Witness = witness
+
+		err = verifyTxIn(redeemTx, i, outputFetcher(redeemTx.TxIn[i].PreviousOutPoint), sigHashes, outputFetcher)
+		if err != nil {
+			return &ErrInputSignature{Index: i, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// generateMultiSigScript helper for tests
+func generateMultiSigScript(t *testing.T, nRequired int, wifPrivateKeys ...*btcutil.WIF) []byte {
+	pubKeys := make([]*btcutil.AddressPubKey, 0, len(wifPrivateKeys))
+	for _, wifPrivateKey := range wifPrivateKeys {
+		pubKey, err := btcutil.NewAddressPubKey(wifPrivateKey.SerializePubKey(), &chaincfg.TestNet3Params)
+		require.NoError(t, err)
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	multiSigScript, err := txscript.MultiSigScript(pubKeys, nRequired)
+	require.NoError(t, err)
+
+	return multiSigScript
+}
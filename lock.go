@@ -0,0 +1,126 @@
+package tx_forge
+
+import (
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// Locker builds pkScript of ForgeTxOut, it's the way to add your own script types
+type Locker interface {
+	LockingScript(network *chaincfg.Params) ([]byte, error)
+}
+
+// AddressLocker pays to any standard address: P2PKH, P2SH, P2WPKH, P2WSH, P2TR
+type AddressLocker struct {
+	Address string
+}
+
+func (l *AddressLocker) LockingScript(network *chaincfg.Params) ([]byte, error) {
+	destinationAddr, err := btcutil.DecodeAddress(l.Address, network)
+	if err != nil {
+		// bech32 address of another network isn't decoded at all
+		for _, otherNetwork := range knownNetworks {
+			if _, otherErr := btcutil.DecodeAddress(l.Address, otherNetwork); otherErr == nil && otherNetwork.Net != network.Net {
+				return nil, errors.Wrapf(ErrAddressNetworkMismatch, "%s is %s address", l.Address, otherNetwork.Name)
+			}
+		}
+		return nil, errors.Wrapf(ErrInvalidTxOut, "address %s: %v", l.Address, err)
+	}
+	if !destinationAddr.IsForNet(network) {
+		return nil, errors.Wrapf(ErrAddressNetworkMismatch, "%s isn't %s address", l.Address, network.Name)
+	}
+
+	return txscript.PayToAddrScript(destinationAddr)
+}
+
+// knownNetworks are networks addresses may be of
+var knownNetworks = []*chaincfg.Params{
+	&chaincfg.MainNetParams,
+	&chaincfg.TestNet3Params,
+	&chaincfg.RegressionNetParams,
+	&chaincfg.SimNetParams,
+	&chaincfg.SigNetParams,
+}
+
+// NullDataLocker makes provably unspendable OP_RETURN <data> output, its ForgeTxOut.Value must be 0.
+// Data is limited to txscript.MaxDataCarrierSize bytes, and there may be only one such output in tx by relay policy
+type NullDataLocker struct {
+	Data []byte
+}
+
+func (l *NullDataLocker) LockingScript(*chaincfg.Params) ([]byte, error) {
+	pkScript, err := txscript.NullDataScript(l.Data)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidTxOut, err.Error())
+	}
+
+	return pkScript, nil
+}
+
+// ScriptLocker locks to arbitrary PkScript, e.g. HTLC or any other script without address encoding.
+// Non-standard scripts are rejected unless Params.NonStandardOutputs allows them
+type ScriptLocker struct {
+	PkScript []byte
+}
+
+// NewScriptLockerFromHex is ScriptLocker of hex encoded pkScript
+func NewScriptLockerFromHex(pkScriptHex string) (*ScriptLocker, error) {
+	pkScript, err := hex.DecodeString(pkScriptHex)
+	if err != nil {
+		return nil, errors.Wrap(err, "pkScript hex")
+	}
+
+	return &ScriptLocker{PkScript: pkScript}, nil
+}
+
+func (l *ScriptLocker) LockingScript(*chaincfg.Params) ([]byte, error) {
+	if len(l.PkScript) == 0 {
+		return nil, errors.Wrap(ErrInvalidTxOut, "pkScript is empty")
+	}
+
+	return l.PkScript, nil
+}
+
+// NonStandardPolicy is what to do with outputs which pkScript is non-standard, such tx isn't relayed by nodes
+type NonStandardPolicy int
+
+const (
+	// NonStandardReject fails forging
+	NonStandardReject NonStandardPolicy = iota
+	// NonStandardWarn forges tx and reports the outputs in ForgeSummary.Warnings
+	NonStandardWarn
+)
+
+// maxStandardMultiSigKeys is max n of bare m-of-n multisig output relayed by nodes
+const maxStandardMultiSigKeys = 3
+
+// isStandardPkScript says whether nodes relay tx with an output locked by pkScript
+func isStandardPkScript(pkScript []byte) bool {
+	switch txscript.GetScriptClass(pkScript) {
+	case txscript.NonStandardTy:
+		return false
+	case txscript.MultiSigTy:
+		numPubKeys, _, err := txscript.CalcMultiSigStats(pkScript)
+		return err == nil && numPubKeys <= maxStandardMultiSigKeys
+	default:
+		return true
+	}
+}
+
+// TxOutSize is serialized size of the output locked by pkScript
+func TxOutSize(pkScript []byte) int {
+	return wire.NewTxOut(0, pkScript).SerializeSize()
+}
+
+// locker is ForgeTxOut.Locker, or AddressLocker of ForgeTxOut.Address
+func (txout *ForgeTxOut) locker() Locker {
+	if txout.Locker != nil {
+		return txout.Locker
+	}
+
+	return &AddressLocker{Address: txout.Address}
+}
@@ -0,0 +1,295 @@
+package tx_forge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// opTrueLocker locks to P2WSH of OP_TRUE script, it's the simplest custom Locker
+type opTrueLocker struct{}
+
+func (l *opTrueLocker) LockingScript(*chaincfg.Params) ([]byte, error) {
+	scriptHash := sha256.Sum256([]byte{txscript.OP_TRUE})
+	return txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(scriptHash[:]).Script()
+}
+
+func TestLocker(t *testing.T) {
+	testParams := &Params{
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
+	}
+	pkScript1 := []byte{txscript.OP_HASH160, txscript.OP_DATA_20, 0x90, 0xc6, 0xad, 0xda, 0xd6, 0xab, 0xcb, 0x92, 0x9b, 0x6e, 0xdd, 0x28, 0x33, 0x39, 0x7a, 0xed, 0x1b, 0x5c, 0x6f, 0x5e, txscript.OP_EQUAL}
+
+	wifPrivateKey1, err := btcutil.DecodeWIF("cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML")
+	require.NoError(t, err)
+
+	opTruePkScript, err := (&opTrueLocker{}).LockingScript(testParams.Network)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name   string
+		txOuts []ForgeTxOut
+
+		wantPkScripts [][]byte
+		wantErr       bool
+	}{
+		{
+			name:          "ok, address locker",
+			txOuts:        []ForgeTxOut{{Value: 10000, Locker: &AddressLocker{Address: p2sh1}}},
+			wantPkScripts: [][]byte{pkScript1},
+		},
+		{
+			name:          "ok, custom locker",
+			txOuts:        []ForgeTxOut{{Value: 10000, Locker: &opTrueLocker{}}},
+			wantPkScripts: [][]byte{opTruePkScript},
+		},
+		{
+			name: "ok, locker takes precedence over address",
+			txOuts: []ForgeTxOut{
+				{Value: 5000, Address: p2sh1, Locker: &opTrueLocker{}},
+				{Value: 5000, Address: p2sh1},
+			},
+			wantPkScripts: [][]byte{opTruePkScript, pkScript1},
+		},
+		{
+			name:    "error, address is for wrong network",
+			txOuts:  []ForgeTxOut{{Value: 10000, Locker: &AddressLocker{Address: "3CuDaAXPUQJGLpyaZThy12s4APdd2qXK1k"}}},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 10000, pkScript1, wifPrivateKey1)}
+
+			redeemTx, _, err := ForgeTx(txIns, tc.txOuts, testParams)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, redeemTx.TxOut, len(tc.wantPkScripts))
+			for i, wantPkScript := range tc.wantPkScripts {
+				assert.Equal(t, wantPkScript, redeemTx.TxOut[i].PkScript)
+				assert.Equal(t, redeemTx.TxOut[i].SerializeSize(), TxOutSize(wantPkScript))
+			}
+		})
+	}
+}
+
+func TestNullDataLocker(t *testing.T) {
+	testParams := &Params{
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
+	}
+	pkScript1 := []byte{txscript.OP_HASH160, txscript.OP_DATA_20, 0x90, 0xc6, 0xad, 0xda, 0xd6, 0xab, 0xcb, 0x92, 0x9b, 0x6e, 0xdd, 0x28, 0x33, 0x39, 0x7a, 0xed, 0x1b, 0x5c, 0x6f, 0x5e, txscript.OP_EQUAL}
+
+	wifPrivateKey1, err := btcutil.DecodeWIF("cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML")
+	require.NoError(t, err)
+
+	documentHash := sha256.Sum256([]byte("document"))
+
+	testcases := []struct {
+		name   string
+		txOuts []ForgeTxOut
+
+		wantNullDataIdx int
+		wantErr         bool
+	}{
+		{
+			name: "ok, data after payment",
+			txOuts: []ForgeTxOut{
+				{Value: 10000, Address: p2sh1},
+				{Value: 0, Locker: &NullDataLocker{Data: documentHash[:]}},
+			},
+			wantNullDataIdx: 1,
+		},
+		{
+			name: "ok, data before payment, fee isn't deducted from it",
+			txOuts: []ForgeTxOut{
+				{Value: 0, Locker: &NullDataLocker{Data: documentHash[:]}},
+				{Value: 10000, Address: p2sh1},
+			},
+			wantNullDataIdx: 0,
+		},
+		{
+			name: "ok, max data size",
+			txOuts: []ForgeTxOut{
+				{Value: 10000, Address: p2sh1},
+				{Value: 0, Locker: &NullDataLocker{Data: make([]byte, txscript.MaxDataCarrierSize)}},
+			},
+			wantNullDataIdx: 1,
+		},
+		{
+			name: "error, data is too long",
+			txOuts: []ForgeTxOut{
+				{Value: 10000, Address: p2sh1},
+				{Value: 0, Locker: &NullDataLocker{Data: make([]byte, txscript.MaxDataCarrierSize+1)}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error, data output has value",
+			txOuts: []ForgeTxOut{
+				{Value: 9000, Address: p2sh1},
+				{Value: 1000, Locker: &NullDataLocker{Data: documentHash[:]}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error, two data outputs",
+			txOuts: []ForgeTxOut{
+				{Value: 10000, Address: p2sh1},
+				{Value: 0, Locker: &NullDataLocker{Data: documentHash[:]}},
+				{Value: 0, Locker: &NullDataLocker{Data: documentHash[:]}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "error, nothing to pay fee from",
+			txOuts: []ForgeTxOut{
+				{Value: 0, Locker: &NullDataLocker{Data: documentHash[:]}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 10000, pkScript1, wifPrivateKey1)}
+
+			redeemTx, sumResult, err := ForgeTx(txIns, tc.txOuts, testParams)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, redeemTx.TxOut, len(tc.txOuts))
+			nullDataTxOut := redeemTx.TxOut[tc.wantNullDataIdx]
+			assert.Equal(t, txscript.NullDataTy, txscript.GetScriptClass(nullDataTxOut.PkScript))
+			assert.Zero(t, nullDataTxOut.Value)
+
+			// data output is paid for
+			assert.GreaterOrEqual(t, sumResult.Fee, vSize(redeemTx)*testParams.FeeRate)
+		})
+	}
+}
+
+func TestScriptLocker(t *testing.T) {
+	testParams := &Params{
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
+	}
+	warnParams := *testParams
+	warnParams.NonStandardOutputs = NonStandardWarn
+
+	pkScript1 := []byte{txscript.OP_HASH160, txscript.OP_DATA_20, 0x90, 0xc6, 0xad, 0xda, 0xd6, 0xab, 0xcb, 0x92, 0x9b, 0x6e, 0xdd, 0x28, 0x33, 0x39, 0x7a, 0xed, 0x1b, 0x5c, 0x6f, 0x5e, txscript.OP_EQUAL}
+
+	wifPrivateKey1, err := btcutil.DecodeWIF("cMdRNN4Fwmvbictryk69BA5fDGxHqFe7iNDxCC3H9yhxCWoKvUML")
+	require.NoError(t, err)
+	wifPrivateKey2, err := btcutil.DecodeWIF("cNsAQ7t1SFFDvXsLaMZ4xTg9bqK9RZNWnQDHmPGEPpn5QVRgGGXV")
+	require.NoError(t, err)
+	wifPrivateKey3, err := btcutil.DecodeWIF("cVUJncM2GPMBnb3TFS8zU4CQ1qHgZLRdEwg3iFyZwds3AL3EK56U")
+	require.NoError(t, err)
+	wifPrivateKey4, err := btcutil.DecodeWIF("cTrswWxoZEqaPwMizFtnezNk8nKwHaQqC4i6LTeHumQTackhk8Bz")
+	require.NoError(t, err)
+
+	// bare HTLC: OP_IF OP_SHA256 <hash> OP_EQUALVERIFY <pubkey1> OP_ELSE <locktime> OP_CHECKLOCKTIMEVERIFY OP_DROP <pubkey2> OP_ENDIF OP_CHECKSIG
+	preimageHash := sha256.Sum256([]byte("txforge"))
+	htlcScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_IF).
+		AddOp(txscript.OP_SHA256).AddData(preimageHash[:]).AddOp(txscript.OP_EQUALVERIFY).
+		AddData(wifPrivateKey1.SerializePubKey()).
+		AddOp(txscript.OP_ELSE).
+		AddInt64(2_500_000).AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).AddOp(txscript.OP_DROP).
+		AddData(wifPrivateKey2.SerializePubKey()).
+		AddOp(txscript.OP_ENDIF).
+		AddOp(txscript.OP_CHECKSIG).
+		Script()
+	require.NoError(t, err)
+
+	htlcScriptHash := sha256.Sum256(htlcScript)
+	p2wshHTLCScript, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(htlcScriptHash[:]).Script()
+	require.NoError(t, err)
+
+	p2wshHTLCLocker, err := NewScriptLockerFromHex(hex.EncodeToString(p2wshHTLCScript))
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name     string
+		locker   Locker
+		params   *Params
+		pkScript []byte
+
+		wantWarnings int
+		wantErr      bool
+	}{
+		{
+			name:     "ok, p2wsh of htlc from hex",
+			locker:   p2wshHTLCLocker,
+			params:   testParams,
+			pkScript: p2wshHTLCScript,
+		},
+		{
+			name:     "ok, bare 1-of-3 multisig is standard",
+			locker:   &ScriptLocker{PkScript: generateMultiSigScript(t, 1, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)},
+			params:   testParams,
+			pkScript: generateMultiSigScript(t, 1, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3),
+		},
+		{
+			name:    "error, bare 1-of-4 multisig is non-standard",
+			locker:  &ScriptLocker{PkScript: generateMultiSigScript(t, 1, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3, wifPrivateKey4)},
+			params:  testParams,
+			wantErr: true,
+		},
+		{
+			name:    "error, bare htlc is non-standard",
+			locker:  &ScriptLocker{PkScript: htlcScript},
+			params:  testParams,
+			wantErr: true,
+		},
+		{
+			name:         "ok, bare htlc with warning",
+			locker:       &ScriptLocker{PkScript: htlcScript},
+			params:       &warnParams,
+			pkScript:     htlcScript,
+			wantWarnings: 1,
+		},
+		{
+			name:    "error, empty script",
+			locker:  &ScriptLocker{},
+			params:  &warnParams,
+			wantErr: true,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 10000, pkScript1, wifPrivateKey1)}
+
+			redeemTx, sumResult, err := ForgeTx(txIns, []ForgeTxOut{{Value: 10000, Locker: tc.locker}}, tc.params)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			require.Len(t, redeemTx.TxOut, 1)
+			assert.Equal(t, tc.pkScript, redeemTx.TxOut[0].PkScript)
+			assert.Len(t, sumResult.Warnings, tc.wantWarnings)
+		})
+	}
+
+	t.Run("error, invalid hex", func(t *testing.T) {
+		_, err := NewScriptLockerFromHex("0020zz")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,177 @@
+package tx_forge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// ForgePSBT is ForgeTx handing tx off to signers: unsigned BIP174 packet with the fee and change of EstimateTx.
+// Inputs carry what signers need: prevouts, redeem and witness scripts, taproot data, and BIP32 derivations of
+// ForgeTxIn.Bip32Derivation. Private keys aren't needed, but P2SH-P2WPKH redeem script is built from the pubkey of
+// Signer, WIFPrivKey or the only Bip32Derivation
+func ForgePSBT(txins []ForgeTxIn, txouts []ForgeTxOut, params *Params) (*psbt.Packet, *ForgeSummary, error) {
+	unsignedParams := *params
+	unsignedParams.NeedToSign = false
+
+	redeemTx, summary, err := ForgeTx(txins, txouts, &unsignedParams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	packet, err := psbt.NewFromUnsignedTx(redeemTx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range txins {
+		if err := fillPSBTInput(&packet.Inputs[i], &txins[i], params.Network); err != nil {
+			return nil, nil, errors.Wrapf(err, "txin %d", i)
+		}
+	}
+
+	for i := range txouts {
+		packet.Outputs[i].Bip32Derivation = txouts[i].Bip32Derivation
+	}
+	if summary.Change > 0 {
+		packet.Outputs[len(txouts)].Bip32Derivation = params.ChangeBip32Derivation
+	}
+
+	return packet, summary, nil
+}
+
+// fillPSBTInput sets prevout of txin and scripts of its builtin unlocker to pInput
+func fillPSBTInput(pInput *psbt.PInput, txin *ForgeTxIn, network *chaincfg.Params) error {
+	prevOut := wire.NewTxOut(int64(txin.Utxo.Value), txin.Utxo.PubKeyScript)
+
+	// signatures aren't made here, only the shape of the input matters
+	unlocker := txin.unlocker(false)
+	if txin.PrevTx != nil {
+		if txin.PrevTx.TxHash().String() != txin.Utxo.TxID {
+			return errors.Wrapf(ErrInvalidTxIn, "PrevTx hash %s isn't utxo txId %s", txin.PrevTx.TxHash(), txin.Utxo.TxID)
+		}
+		if int(txin.Utxo.Vout) >= len(txin.PrevTx.TxOut) || !psbt.TxOutsEqual(txin.PrevTx.TxOut[txin.Utxo.Vout], prevOut) {
+			return errors.Wrapf(ErrInvalidTxIn, "PrevTx output %d isn't utxo", txin.Utxo.Vout)
+		}
+		pInput.NonWitnessUtxo = txin.PrevTx
+	}
+	// legacy inputs need the whole PrevTx by BIP174, its output is all there is without it
+	if unlocker.Size().Witness > 0 || txin.PrevTx == nil {
+		pInput.WitnessUtxo = prevOut
+	}
+
+	pInput.Bip32Derivation = txin.Bip32Derivation
+	pInput.SighashType = txin.SigHashType
+
+	switch u := unlocker.(type) {
+	case *P2SHP2WPKHUnlocker:
+		var pubKey []byte
+		switch {
+		case u.Signer != nil:
+			signerPubKey, err := u.Signer.PubKey()
+			if err != nil {
+				return err
+			}
+			pubKey = signerPubKey
+		case len(txin.Bip32Derivation) == 1:
+			pubKey = txin.Bip32Derivation[0].PubKey
+		default:
+			return errors.Wrap(ErrInvalidTxIn, "P2SH-P2WPKH redeem script needs Signer, WIFPrivKey or the only Bip32Derivation")
+		}
+
+		witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(pubKey)).Script()
+		if err != nil {
+			return err
+		}
+		pInput.RedeemScript = witnessProgram
+
+	case *P2WSHMultiSigUnlocker:
+		pInput.WitnessScript = u.WitnessScript
+		if u.Nested {
+			witnessScriptHash := sha256.Sum256(u.WitnessScript)
+			witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(witnessScriptHash[:]).Script()
+			if err != nil {
+				return err
+			}
+			pInput.RedeemScript = witnessProgram
+		}
+
+	case *P2SHMultiSigUnlocker:
+		pInput.RedeemScript = u.RedeemScript
+
+	case *P2TRUnlocker:
+		pInput.TaprootMerkleRoot = u.MerkleRoot
+		if u.Signer != nil {
+			internalKey, err := signerPubKey(u.Signer)
+			if err != nil {
+				return err
+			}
+			pInput.TaprootInternalKey = schnorr.SerializePubKey(internalKey)
+		}
+		pInput.TaprootBip32Derivation = taprootBip32Derivation(txin.Bip32Derivation, nil)
+		pInput.Bip32Derivation = nil
+
+	case *P2TRScriptUnlocker:
+		controlBlock, err := txscript.ParseControlBlock(u.TapScript.ControlBlock)
+		if err != nil {
+			return errors.Wrapf(ErrInvalidTxIn, "control block: %v", err)
+		}
+		tapLeaf := txscript.NewTapLeaf(controlBlock.LeafVersion, u.TapScript.LeafScript)
+		leafHash := tapLeaf.TapHash()
+
+		pInput.TaprootLeafScript = []*psbt.TaprootTapLeafScript{{
+			ControlBlock: u.TapScript.ControlBlock,
+			Script:       u.TapScript.LeafScript,
+			LeafVersion:  controlBlock.LeafVersion,
+		}}
+		pInput.TaprootInternalKey = schnorr.SerializePubKey(controlBlock.InternalKey)
+		pInput.TaprootBip32Derivation = taprootBip32Derivation(txin.Bip32Derivation, leafHash[:])
+		pInput.Bip32Derivation = nil
+	}
+
+	// redeem script has to be the one pkScript commits to, otherwise signers can't spend it
+	if pInput.RedeemScript != nil {
+		redeemScriptHash := btcutil.Hash160(pInput.RedeemScript)
+		pushes, err := txscript.PushedData(txin.Utxo.PubKeyScript)
+		if err != nil || !txscript.IsPayToScriptHash(txin.Utxo.PubKeyScript) || !bytes.Equal(pushes[0], redeemScriptHash) {
+			return errors.Wrapf(ErrInvalidTxIn, "redeem script %x doesn't match pkScript %x", pInput.RedeemScript, txin.Utxo.PubKeyScript)
+		}
+	}
+
+	return nil
+}
+
+// taprootBip32Derivation is derivations of x-only pubkeys, involved in the leaf of leafHash if it's set
+func taprootBip32Derivation(derivations []*psbt.Bip32Derivation, leafHash []byte) []*psbt.TaprootBip32Derivation {
+	if len(derivations) == 0 {
+		return nil
+	}
+
+	taprootDerivations := make([]*psbt.TaprootBip32Derivation, 0, len(derivations))
+	for _, derivation := range derivations {
+		xOnlyPubKey := derivation.PubKey
+		if len(xOnlyPubKey) == 33 {
+			xOnlyPubKey = xOnlyPubKey[1:]
+		}
+
+		var leafHashes [][]byte
+		if leafHash != nil {
+			leafHashes = [][]byte{leafHash}
+		}
+
+		taprootDerivations = append(taprootDerivations, &psbt.TaprootBip32Derivation{
+			XOnlyPubKey:          xOnlyPubKey,
+			LeafHashes:           leafHashes,
+			MasterKeyFingerprint: derivation.MasterKeyFingerprint,
+			Bip32Path:            derivation.Bip32Path,
+		})
+	}
+
+	return taprootDerivations
+}
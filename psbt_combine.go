@@ -0,0 +1,429 @@
+package tx_forge
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// MissingSignatures of packet input are how many signatures it still lacks and keys which can make them
+type MissingSignatures struct {
+	Index int `json:"index"`
+	// Need is the least number of signatures finalizing the input
+	Need int `json:"need"`
+	// PubKeys haven't signed the input yet: multisig keys, P2PK key, P2PKH and P2WPKH key of Bip32Derivation,
+	// x-only taproot internal key and keys of leaves
+	PubKeys [][]byte `json:"pubKeys"`
+}
+
+// CombinePSBT merges packets of the same unsigned tx, e.g. ones signed by different parties, into a new packet.
+// Packets aren't changed. Different values of the same field are ErrPSBTConflict, while finalized input wins
+// over partial signatures, since finalizer drops them
+func CombinePSBT(packets ...*psbt.Packet) (*psbt.Packet, error) {
+	if len(packets) == 0 {
+		return nil, errors.Wrap(ErrInvalidParams, "no packets to combine")
+	}
+
+	combined, err := copyPSBT(packets[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "packet 0")
+	}
+
+	txHash := combined.UnsignedTx.TxHash()
+	for i, packet := range packets[1:] {
+		packet, err := copyPSBT(packet)
+		if err != nil {
+			return nil, errors.Wrapf(err, "packet %d", i+1)
+		}
+		if packet.UnsignedTx.TxHash() != txHash {
+			return nil, errors.Wrapf(ErrInvalidParams, "packet %d is of tx %s, not %s", i+1, packet.UnsignedTx.TxHash(), txHash)
+		}
+		if len(packet.Inputs) != len(combined.Inputs) || len(packet.Outputs) != len(combined.Outputs) {
+			return nil, errors.Wrapf(ErrInvalidParams, "packet %d has %d inputs and %d outputs of %d and %d",
+				i+1, len(packet.Inputs), len(packet.Outputs), len(combined.Inputs), len(combined.Outputs))
+		}
+
+		if err := mergeUnknowns(&combined.Unknowns, packet.Unknowns); err != nil {
+			return nil, errors.Wrapf(err, "packet %d", i+1)
+		}
+		for j := range packet.Inputs {
+			if err := mergePSBTInput(&combined.Inputs[j], &packet.Inputs[j]); err != nil {
+				return nil, errors.Wrapf(err, "packet %d: txin %d", i+1, j)
+			}
+		}
+		for j := range packet.Outputs {
+			if err := mergePSBTOutput(&combined.Outputs[j], &packet.Outputs[j]); err != nil {
+				return nil, errors.Wrapf(err, "packet %d: txout %d", i+1, j)
+			}
+		}
+	}
+
+	if err := combined.SanityCheck(); err != nil {
+		return nil, err
+	}
+
+	return combined, nil
+}
+
+// PSBTMissingSignatures reports inputs of packet which aren't finalized and can't be yet, in order of inputs.
+// Inputs having enough signatures are ready for FinalizePSBT and aren't reported
+func PSBTMissingSignatures(packet *psbt.Packet) ([]MissingSignatures, error) {
+	outputFetcher, err := psbtOutputFetcher(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []MissingSignatures
+	for i := range packet.Inputs {
+		pInput := &packet.Inputs[i]
+		if pInput.FinalScriptSig != nil || pInput.FinalScriptWitness != nil {
+			continue
+		}
+
+		prevOut := outputFetcher(packet.UnsignedTx.TxIn[i].PreviousOutPoint)
+		_, _, err := finalPSBTInputScripts(pInput, prevOut)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errNotEnoughSignatures) {
+			return nil, errors.Wrapf(err, "txin %d", i)
+		}
+
+		var inputMissing MissingSignatures
+		if txscript.IsPayToTaproot(prevOut.PkScript) {
+			inputMissing, err = missingTaprootSignatures(pInput)
+		} else {
+			inputMissing, err = missingSignatures(pInput, prevOut)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "txin %d", i)
+		}
+		inputMissing.Index = i
+		missing = append(missing, inputMissing)
+	}
+
+	return missing, nil
+}
+
+// missingSignatures of ECDSA signed pInput, which doesn't have enough of them
+func missingSignatures(pInput *psbt.PInput, prevOut *wire.TxOut) (MissingSignatures, error) {
+	scriptCode, _, err := psbtScriptCode(pInput, prevOut)
+	if err != nil {
+		return MissingSignatures{}, err
+	}
+
+	switch class := txscript.GetScriptClass(scriptCode); class {
+	case txscript.MultiSigTy:
+		_, numSigs, err := txscript.CalcMultiSigStats(scriptCode)
+		if err != nil {
+			return MissingSignatures{}, err
+		}
+		pubKeys, err := txscript.PushedData(scriptCode)
+		if err != nil {
+			return MissingSignatures{}, err
+		}
+
+		missing := MissingSignatures{Need: numSigs}
+		for _, pubKey := range pubKeys {
+			if findPartialSig(pInput, pubKey) != nil {
+				missing.Need--
+				continue
+			}
+			missing.PubKeys = append(missing.PubKeys, pubKey)
+		}
+		return missing, nil
+
+	case txscript.PubKeyTy:
+		pubKeys, err := txscript.PushedData(scriptCode)
+		if err != nil {
+			return MissingSignatures{}, err
+		}
+		return MissingSignatures{Need: 1, PubKeys: pubKeys}, nil
+
+	default:
+		// the key is known by its hash only, the one of derivations may be it
+		missing := MissingSignatures{Need: 1}
+		for _, derivation := range pInput.Bip32Derivation {
+			if scriptHasKey(scriptCode, derivation.PubKey) {
+				missing.PubKeys = append(missing.PubKeys, derivation.PubKey)
+			}
+		}
+		return missing, nil
+	}
+}
+
+// missingTaprootSignatures of pInput, which has neither key-path signature nor leaf signed by all of its keys.
+// Key-path needs one signature, if the internal key is known or there are no leaves to spend
+func missingTaprootSignatures(pInput *psbt.PInput) (MissingSignatures, error) {
+	var missing MissingSignatures
+	if pInput.TaprootInternalKey != nil || len(pInput.TaprootLeafScript) == 0 {
+		missing.Need = 1
+		if pInput.TaprootInternalKey != nil {
+			missing.PubKeys = append(missing.PubKeys, pInput.TaprootInternalKey)
+		}
+	}
+
+	for _, leafScript := range pInput.TaprootLeafScript {
+		tapLeaf := txscript.NewTapLeaf(leafScript.LeafVersion, leafScript.Script)
+		leafHash := tapLeaf.TapHash()
+
+		pushes, err := txscript.PushedData(leafScript.Script)
+		if err != nil {
+			return MissingSignatures{}, err
+		}
+
+		need := 0
+		for _, push := range pushes {
+			if len(push) != len(leafHash) || findTaprootScriptSpendSig(pInput, push, leafHash[:]) != nil {
+				continue
+			}
+			need++
+			if !containsBytes(missing.PubKeys, push) {
+				missing.PubKeys = append(missing.PubKeys, push)
+			}
+		}
+		if need > 0 && (missing.Need == 0 || need < missing.Need) {
+			missing.Need = need
+		}
+	}
+
+	return missing, nil
+}
+
+// copyPSBT is a deep copy of packet, made by serializing it
+func copyPSBT(packet *psbt.Packet) (*psbt.Packet, error) {
+	var buf bytes.Buffer
+	if err := packet.Serialize(&buf); err != nil {
+		return nil, err
+	}
+
+	return psbt.NewFromRawBytes(&buf, false)
+}
+
+// mergePSBTInput adds fields of src missing in dst, and checks the ones both have are the same
+func mergePSBTInput(dst, src *psbt.PInput) error {
+	if dst.NonWitnessUtxo == nil {
+		dst.NonWitnessUtxo = src.NonWitnessUtxo
+	} else if src.NonWitnessUtxo != nil && dst.NonWitnessUtxo.TxHash() != src.NonWitnessUtxo.TxHash() {
+		return errors.Wrap(ErrPSBTConflict, "NonWitnessUtxo")
+	}
+	if dst.WitnessUtxo == nil {
+		dst.WitnessUtxo = src.WitnessUtxo
+	} else if src.WitnessUtxo != nil && !psbt.TxOutsEqual(dst.WitnessUtxo, src.WitnessUtxo) {
+		return errors.Wrap(ErrPSBTConflict, "WitnessUtxo")
+	}
+
+	if err := mergeBytes("FinalScriptSig", &dst.FinalScriptSig, src.FinalScriptSig); err != nil {
+		return err
+	}
+	if err := mergeBytes("FinalScriptWitness", &dst.FinalScriptWitness, src.FinalScriptWitness); err != nil {
+		return err
+	}
+	if err := mergeUnknowns(&dst.Unknowns, src.Unknowns); err != nil {
+		return err
+	}
+	if dst.FinalScriptSig != nil || dst.FinalScriptWitness != nil {
+		*dst = psbt.PInput{
+			NonWitnessUtxo:     dst.NonWitnessUtxo,
+			WitnessUtxo:        dst.WitnessUtxo,
+			FinalScriptSig:     dst.FinalScriptSig,
+			FinalScriptWitness: dst.FinalScriptWitness,
+			Unknowns:           dst.Unknowns,
+		}
+		return nil
+	}
+
+	if dst.SighashType == 0 {
+		dst.SighashType = src.SighashType
+	} else if src.SighashType != 0 && dst.SighashType != src.SighashType {
+		return errors.Wrapf(ErrPSBTConflict, "SighashType %d and %d", dst.SighashType, src.SighashType)
+	}
+
+	for _, field := range []struct {
+		name string
+		dst  *[]byte
+		src  []byte
+	}{
+		{"RedeemScript", &dst.RedeemScript, src.RedeemScript},
+		{"WitnessScript", &dst.WitnessScript, src.WitnessScript},
+		{"TaprootKeySpendSig", &dst.TaprootKeySpendSig, src.TaprootKeySpendSig},
+		{"TaprootInternalKey", &dst.TaprootInternalKey, src.TaprootInternalKey},
+		{"TaprootMerkleRoot", &dst.TaprootMerkleRoot, src.TaprootMerkleRoot},
+	} {
+		if err := mergeBytes(field.name, field.dst, field.src); err != nil {
+			return err
+		}
+	}
+
+	for _, partialSig := range src.PartialSigs {
+		found := findPartialSig(dst, partialSig.PubKey)
+		if found == nil {
+			dst.PartialSigs = append(dst.PartialSigs, partialSig)
+		} else if !bytes.Equal(found.Signature, partialSig.Signature) {
+			return errors.Wrapf(ErrPSBTConflict, "PartialSig of %x", partialSig.PubKey)
+		}
+	}
+
+	for _, sig := range src.TaprootScriptSpendSig {
+		found := findTaprootScriptSpendSig(dst, sig.XOnlyPubKey, sig.LeafHash)
+		if found == nil {
+			dst.TaprootScriptSpendSig = append(dst.TaprootScriptSpendSig, sig)
+		} else if !found.EqualKey(sig) || !bytes.Equal(found.Signature, sig.Signature) || found.SigHash != sig.SigHash {
+			return errors.Wrapf(ErrPSBTConflict, "TaprootScriptSpendSig of %x", sig.XOnlyPubKey)
+		}
+	}
+
+	for _, leafScript := range src.TaprootLeafScript {
+		found := false
+		for _, dstLeafScript := range dst.TaprootLeafScript {
+			if !bytes.Equal(dstLeafScript.ControlBlock, leafScript.ControlBlock) {
+				continue
+			}
+			if !bytes.Equal(dstLeafScript.Script, leafScript.Script) || dstLeafScript.LeafVersion != leafScript.LeafVersion {
+				return errors.Wrapf(ErrPSBTConflict, "TaprootLeafScript of control block %x", leafScript.ControlBlock)
+			}
+			found = true
+		}
+		if !found {
+			dst.TaprootLeafScript = append(dst.TaprootLeafScript, leafScript)
+		}
+	}
+
+	if err := mergeBip32Derivation(&dst.Bip32Derivation, src.Bip32Derivation); err != nil {
+		return err
+	}
+
+	return mergeTaprootBip32Derivation(&dst.TaprootBip32Derivation, src.TaprootBip32Derivation)
+}
+
+// mergePSBTOutput adds fields of src missing in dst, and checks the ones both have are the same
+func mergePSBTOutput(dst, src *psbt.POutput) error {
+	for _, field := range []struct {
+		name string
+		dst  *[]byte
+		src  []byte
+	}{
+		{"RedeemScript", &dst.RedeemScript, src.RedeemScript},
+		{"WitnessScript", &dst.WitnessScript, src.WitnessScript},
+		{"TaprootInternalKey", &dst.TaprootInternalKey, src.TaprootInternalKey},
+		{"TaprootTapTree", &dst.TaprootTapTree, src.TaprootTapTree},
+	} {
+		if err := mergeBytes(field.name, field.dst, field.src); err != nil {
+			return err
+		}
+	}
+
+	if err := mergeBip32Derivation(&dst.Bip32Derivation, src.Bip32Derivation); err != nil {
+		return err
+	}
+	if err := mergeTaprootBip32Derivation(&dst.TaprootBip32Derivation, src.TaprootBip32Derivation); err != nil {
+		return err
+	}
+
+	return mergeUnknowns(&dst.Unknowns, src.Unknowns)
+}
+
+func mergeBytes(name string, dst *[]byte, src []byte) error {
+	if *dst == nil {
+		*dst = src
+		return nil
+	}
+	if src != nil && !bytes.Equal(*dst, src) {
+		return errors.Wrap(ErrPSBTConflict, name)
+	}
+
+	return nil
+}
+
+func mergeBip32Derivation(dst *[]*psbt.Bip32Derivation, src []*psbt.Bip32Derivation) error {
+	for _, derivation := range src {
+		found := false
+		for _, dstDerivation := range *dst {
+			if !bytes.Equal(dstDerivation.PubKey, derivation.PubKey) {
+				continue
+			}
+			if dstDerivation.MasterKeyFingerprint != derivation.MasterKeyFingerprint ||
+				!bip32PathEqual(dstDerivation.Bip32Path, derivation.Bip32Path) {
+				return errors.Wrapf(ErrPSBTConflict, "Bip32Derivation of %x", derivation.PubKey)
+			}
+			found = true
+		}
+		if !found {
+			*dst = append(*dst, derivation)
+		}
+	}
+
+	return nil
+}
+
+func mergeTaprootBip32Derivation(dst *[]*psbt.TaprootBip32Derivation, src []*psbt.TaprootBip32Derivation) error {
+	for _, derivation := range src {
+		found := false
+		for _, dstDerivation := range *dst {
+			if !bytes.Equal(dstDerivation.XOnlyPubKey, derivation.XOnlyPubKey) {
+				continue
+			}
+			if dstDerivation.MasterKeyFingerprint != derivation.MasterKeyFingerprint ||
+				!bip32PathEqual(dstDerivation.Bip32Path, derivation.Bip32Path) ||
+				len(dstDerivation.LeafHashes) != len(derivation.LeafHashes) {
+				return errors.Wrapf(ErrPSBTConflict, "TaprootBip32Derivation of %x", derivation.XOnlyPubKey)
+			}
+			for _, leafHash := range derivation.LeafHashes {
+				if !containsBytes(dstDerivation.LeafHashes, leafHash) {
+					return errors.Wrapf(ErrPSBTConflict, "TaprootBip32Derivation of %x", derivation.XOnlyPubKey)
+				}
+			}
+			found = true
+		}
+		if !found {
+			*dst = append(*dst, derivation)
+		}
+	}
+
+	return nil
+}
+
+func mergeUnknowns(dst *[]*psbt.Unknown, src []*psbt.Unknown) error {
+	for _, unknown := range src {
+		found := false
+		for _, dstUnknown := range *dst {
+			if !bytes.Equal(dstUnknown.Key, unknown.Key) {
+				continue
+			}
+			if !bytes.Equal(dstUnknown.Value, unknown.Value) {
+				return errors.Wrapf(ErrPSBTConflict, "unknown field %x", unknown.Key)
+			}
+			found = true
+		}
+		if !found {
+			*dst = append(*dst, unknown)
+		}
+	}
+
+	return nil
+}
+
+func bip32PathEqual(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsBytes(items [][]byte, item []byte) bool {
+	for _, it := range items {
+		if bytes.Equal(it, item) {
+			return true
+		}
+	}
+
+	return false
+}
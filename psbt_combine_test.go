@@ -0,0 +1,179 @@
+package tx_forge
+
+import (
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestCombinePSBT(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+	}
+
+	wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+	multiSigScriptHash := sha256.Sum256(multiSigScript)
+	pkScriptP2WSH := payToAddr(btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network))
+	pkScriptP2SHMultiSig := payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network))
+	internalKey := wifPrivateKey1.PrivKey.PubKey()
+	pkScriptP2TR := payToAddr(btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootOutputKey(internalKey, nil)), testParams.Network))
+
+	txIns := []ForgeTxIn{
+		generateTxIn(prevTxId1, 0, 100000, pkScriptP2WSH, nil),
+		generateTxIn(prevTxId1, 1, 100000, pkScriptP2SHMultiSig, nil),
+		generateTxIn(prevTxId1, 2, 100000, pkScriptP2WPKH, nil),
+		generateTxIn(prevTxId1, 3, 100000, pkScriptP2TR, wifPrivateKey1),
+	}
+	txIns[0].WitnessScript = multiSigScript
+	txIns[1].RedeemScript = multiSigScript
+	txIns[2].Bip32Derivation = []*psbt.Bip32Derivation{{PubKey: pubKey1, MasterKeyFingerprint: 1, Bip32Path: []uint32{0}}}
+	txOuts := []ForgeTxOut{{Value: 300000, Address: p2sh1}}
+
+	packet, _, err := ForgePSBT(txIns, txOuts, testParams)
+	require.NoError(t, err)
+
+	// every custodian signs its own copy of the packet, handed off as base64
+	signedBy := func(t *testing.T, keys ...*btcutil.WIF) *psbt.Packet {
+		b64, err := packet.B64Encode()
+		require.NoError(t, err)
+		custodianPacket, err := psbt.NewFromRawBytes(strings.NewReader(b64), true)
+		require.NoError(t, err)
+		_, err = SignPSBT(custodianPacket, WIFSigners(keys...))
+		require.NoError(t, err)
+		return custodianPacket
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		missing, err := PSBTMissingSignatures(packet)
+		require.NoError(t, err)
+		assert.Equal(t, []MissingSignatures{
+			{Index: 0, Need: 2, PubKeys: [][]byte{pubKey1, wifPrivateKey2.SerializePubKey(), wifPrivateKey3.SerializePubKey()}},
+			{Index: 1, Need: 2, PubKeys: [][]byte{pubKey1, wifPrivateKey2.SerializePubKey(), wifPrivateKey3.SerializePubKey()}},
+			{Index: 2, Need: 1, PubKeys: [][]byte{pubKey1}},
+			{Index: 3, Need: 1, PubKeys: [][]byte{schnorr.SerializePubKey(internalKey)}},
+		}, missing)
+
+		packet1 := signedBy(t, wifPrivateKey1)
+		packet2 := signedBy(t, wifPrivateKey2)
+		packet3 := signedBy(t, wifPrivateKey3)
+
+		combined, err := CombinePSBT(packet2, packet3)
+		require.NoError(t, err)
+		assert.Len(t, packet2.Inputs[0].PartialSigs, 1)
+		missing, err = PSBTMissingSignatures(combined)
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 3}, missingIndexes(missing))
+
+		// the first custodian finalizes its single key inputs before the merge
+		require.NoError(t, FinalizePSBT(packet1))
+		combined, err = CombinePSBT(combined, packet1)
+		require.NoError(t, err)
+		missing, err = PSBTMissingSignatures(combined)
+		require.NoError(t, err)
+		assert.Empty(t, missing)
+		assert.Len(t, combined.Inputs[0].PartialSigs, 3)
+		assert.Nil(t, combined.Inputs[2].PartialSigs)
+		assert.NotNil(t, combined.Inputs[2].FinalScriptWitness)
+
+		require.NoError(t, FinalizePSBT(combined))
+		assert.True(t, combined.IsComplete())
+		_, err = ExtractPSBT(combined)
+		require.NoError(t, err)
+
+		// combining is idempotent
+		again, err := CombinePSBT(combined, combined, packet1)
+		require.NoError(t, err)
+		assert.Equal(t, combined, again)
+	})
+
+	t.Run("missing signatures of partially signed multisig", func(t *testing.T) {
+		missing, err := PSBTMissingSignatures(signedBy(t, wifPrivateKey3))
+		require.NoError(t, err)
+		require.Len(t, missing, 4)
+		assert.Equal(t, MissingSignatures{Index: 0, Need: 1, PubKeys: [][]byte{pubKey1, wifPrivateKey2.SerializePubKey()}}, missing[0])
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		testcases := []struct {
+			name         string
+			mutate       func(packet *psbt.Packet)
+			wantConflict bool
+		}{
+			{
+				name: "another tx",
+				mutate: func(packet *psbt.Packet) {
+					packet.UnsignedTx.TxOut[0].Value--
+				},
+			},
+			{
+				name: "WitnessUtxo",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[0].WitnessUtxo = wire.NewTxOut(100001, pkScriptP2WSH)
+				},
+				wantConflict: true,
+			},
+			{
+				name: "PartialSig",
+				mutate: func(packet *psbt.Packet) {
+					signature := packet.Inputs[0].PartialSigs[0].Signature
+					packet.Inputs[0].PartialSigs[0].Signature = append(signature[:len(signature)-1:len(signature)-1], byte(txscript.SigHashNone))
+				},
+				wantConflict: true,
+			},
+			{
+				name: "Bip32Derivation",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[2].Bip32Derivation[0].Bip32Path = []uint32{1}
+				},
+				wantConflict: true,
+			},
+			{
+				name: "RedeemScript",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[1].RedeemScript = pkScriptP2WSH
+				},
+				wantConflict: true,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				packet1 := signedBy(t, wifPrivateKey1)
+				packet2 := signedBy(t, wifPrivateKey1)
+				tc.mutate(packet2)
+
+				_, err := CombinePSBT(packet1, packet2)
+				require.Error(t, err)
+				assert.Equal(t, tc.wantConflict, errors.Is(err, ErrPSBTConflict))
+				assert.Equal(t, !tc.wantConflict, errors.Is(err, ErrInvalidParams))
+			})
+		}
+
+		_, err := CombinePSBT()
+		require.ErrorIs(t, err, ErrInvalidParams)
+	})
+}
+
+func missingIndexes(missing []MissingSignatures) []int {
+	indexes := make([]int, 0, len(missing))
+	for _, m := range missing {
+		indexes = append(indexes, m.Index)
+	}
+	return indexes
+}
@@ -0,0 +1,435 @@
+package tx_forge
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// SignPSBT adds partial signatures of signers to packet inputs they can sign, the rest is left to other signers.
+// It returns indexes of inputs signed. Finalized inputs aren't signed again
+func SignPSBT(packet *psbt.Packet, signers []Signer) ([]int, error) {
+	outputFetcher, err := psbtOutputFetcher(packet)
+	if err != nil {
+		return nil, err
+	}
+	sigHashes := txscript.NewTxSigHashes(packet.UnsignedTx, outputFetcher)
+
+	var signed []int
+	for i := range packet.Inputs {
+		pInput := &packet.Inputs[i]
+		if pInput.FinalScriptSig != nil || pInput.FinalScriptWitness != nil {
+			continue
+		}
+
+		if err := validateSigHashType(pInput.SighashType, i, len(packet.UnsignedTx.TxOut)); err != nil {
+			return nil, errors.Wrapf(err, "txin %d", i)
+		}
+
+		prevOut := outputFetcher(packet.UnsignedTx.TxIn[i].PreviousOutPoint)
+		ctx := &UnlockContext{
+			Tx:          packet.UnsignedTx,
+			Idx:         i,
+			Utxo:        UTXO{Value: int(prevOut.Value), PubKeyScript: prevOut.PkScript},
+			SigHashes:   sigHashes,
+			SigHashType: pInput.SighashType,
+		}
+		ok, err := signPSBTInput(ctx, pInput, signers)
+		if err != nil {
+			return nil, &ErrInputSignature{Index: i, Err: err}
+		}
+		if ok {
+			signed = append(signed, i)
+		}
+	}
+
+	return signed, nil
+}
+
+// FinalizePSBT turns partial signatures of packet inputs satisfying their scripts into final scriptSig and witness,
+// each one is verified by executing its script. Inputs lacking signatures are left as they are,
+// packet.IsComplete says whether there are any
+func FinalizePSBT(packet *psbt.Packet) error {
+	outputFetcher, err := psbtOutputFetcher(packet)
+	if err != nil {
+		return err
+	}
+	sigHashes := txscript.NewTxSigHashes(packet.UnsignedTx, outputFetcher)
+
+	for i := range packet.Inputs {
+		pInput := &packet.Inputs[i]
+		if pInput.FinalScriptSig != nil || pInput.FinalScriptWitness != nil {
+			continue
+		}
+
+		prevOut := outputFetcher(packet.UnsignedTx.TxIn[i].PreviousOutPoint)
+		signatureScript, witness, err := finalPSBTInputScripts(pInput, prevOut)
+		if errors.Is(err, errNotEnoughSignatures) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "txin %d", i)
+		}
+
+		tx := packet.UnsignedTx.Copy()
+		tx.TxIn[i].SignatureScript = signatureScript
+		tx.TxIn[i].Witness = witness
+		if err := verifyTxIn(tx, i, prevOut, sigHashes, outputFetcher); err != nil {
+			return &ErrInputSignature{Index: i, Err: err}
+		}
+
+		var finalScriptWitness bytes.Buffer
+		if len(witness) > 0 {
+			if err := psbt.WriteTxWitness(&finalScriptWitness, witness); err != nil {
+				return err
+			}
+		}
+
+		// BIP174: everything but utxo and final scripts is removed by finalizer
+		*pInput = psbt.PInput{
+			NonWitnessUtxo:     pInput.NonWitnessUtxo,
+			WitnessUtxo:        pInput.WitnessUtxo,
+			FinalScriptSig:     signatureScript,
+			FinalScriptWitness: finalScriptWitness.Bytes(),
+			Unknowns:           pInput.Unknowns,
+		}
+	}
+
+	return nil
+}
+
+// ExtractPSBT is the signed tx of complete packet, each input is verified by executing its script
+func ExtractPSBT(packet *psbt.Packet) (*wire.MsgTx, error) {
+	outputFetcher, err := psbtOutputFetcher(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := psbt.Extract(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	sigHashes := txscript.NewTxSigHashes(tx, outputFetcher)
+	for i := range tx.TxIn {
+		if err := verifyTxIn(tx, i, outputFetcher(tx.TxIn[i].PreviousOutPoint), sigHashes, outputFetcher); err != nil {
+			return nil, &ErrInputSignature{Index: i, Err: err}
+		}
+	}
+
+	return tx, nil
+}
+
+// psbtOutputFetcher fetches previous outputs of packet inputs, from WitnessUtxo or NonWitnessUtxo
+func psbtOutputFetcher(packet *psbt.Packet) (prevOutputFetcher, error) {
+	if len(packet.Inputs) != len(packet.UnsignedTx.TxIn) {
+		return nil, errors.Wrapf(ErrInvalidParams, "packet has %d inputs for %d txins", len(packet.Inputs), len(packet.UnsignedTx.TxIn))
+	}
+
+	prevOuts := make(map[wire.OutPoint]*wire.TxOut, len(packet.Inputs))
+	for i, pInput := range packet.Inputs {
+		outPoint := packet.UnsignedTx.TxIn[i].PreviousOutPoint
+		switch {
+		case pInput.WitnessUtxo != nil:
+			prevOuts[outPoint] = pInput.WitnessUtxo
+		case pInput.NonWitnessUtxo != nil:
+			if pInput.NonWitnessUtxo.TxHash() != outPoint.Hash || int(outPoint.Index) >= len(pInput.NonWitnessUtxo.TxOut) {
+				return nil, errors.Wrapf(ErrInvalidTxIn, "txin %d: NonWitnessUtxo isn't tx of %s", i, outPoint)
+			}
+			prevOuts[outPoint] = pInput.NonWitnessUtxo.TxOut[outPoint.Index]
+		default:
+			return nil, errors.Wrapf(ErrInvalidTxIn, "txin %d has no utxo", i)
+		}
+	}
+
+	return func(out wire.OutPoint) *wire.TxOut {
+		return prevOuts[out]
+	}, nil
+}
+
+// psbtScriptCode is script signed by ECDSA keys of pInput spending prevOut, and whether it's signed as witness one
+func psbtScriptCode(pInput *psbt.PInput, prevOut *wire.TxOut) ([]byte, bool, error) {
+	pkScript := prevOut.PkScript
+	if txscript.IsPayToScriptHash(pkScript) {
+		if pInput.RedeemScript == nil {
+			return nil, false, errors.Wrap(ErrInvalidTxIn, "redeem script is missing")
+		}
+		pkScript = pInput.RedeemScript
+	}
+
+	switch {
+	case txscript.IsPayToWitnessPubKeyHash(pkScript):
+		return pkScript, true, nil
+	case txscript.IsPayToWitnessScriptHash(pkScript):
+		if pInput.WitnessScript == nil {
+			return nil, false, errors.Wrap(ErrInvalidTxIn, "witness script is missing")
+		}
+		return pInput.WitnessScript, true, nil
+	default:
+		return pkScript, false, nil
+	}
+}
+
+// signPSBTInput adds signatures of signers which pInput script has, with the same signing path as Unlockers have
+func signPSBTInput(ctx *UnlockContext, pInput *psbt.PInput, signers []Signer) (bool, error) {
+	prevOut := wire.NewTxOut(int64(ctx.Utxo.Value), ctx.Utxo.PubKeyScript)
+	if txscript.IsPayToTaproot(prevOut.PkScript) {
+		return signPSBTTaprootInput(ctx, pInput, signers)
+	}
+
+	scriptCode, isWitness, err := psbtScriptCode(pInput, prevOut)
+	if err != nil {
+		return false, err
+	}
+
+	signed := false
+	for _, signer := range signers {
+		pubKey, err := signer.PubKey()
+		if err != nil {
+			return false, errors.Wrap(err, "signer pubkey")
+		}
+		if !scriptHasKey(scriptCode, pubKey) || findPartialSig(pInput, pubKey) != nil {
+			continue
+		}
+
+		signature, err := signECDSA(ctx, signer, scriptCode, isWitness)
+		if err != nil {
+			return false, err
+		}
+
+		pInput.PartialSigs = append(pInput.PartialSigs, &psbt.PartialSig{PubKey: pubKey, Signature: signature})
+		signed = true
+	}
+
+	return signed, nil
+}
+
+// signPSBTTaprootInput signs key-path with the key tweaked to output key, and leaves having x-only keys
+func signPSBTTaprootInput(ctx *UnlockContext, pInput *psbt.PInput, signers []Signer) (bool, error) {
+	outputKey := ctx.Utxo.PubKeyScript[2:]
+
+	signed := false
+	for _, signer := range signers {
+		pubKey, err := signerPubKey(signer)
+		if err != nil {
+			return false, err
+		}
+
+		if pInput.TaprootKeySpendSig == nil {
+			tweakedKey := txscript.ComputeTaprootOutputKey(pubKey, pInput.TaprootMerkleRoot)
+			if bytes.Equal(schnorr.SerializePubKey(tweakedKey), outputKey) {
+				signature, err := signTaproot(ctx, signer, pInput.TaprootMerkleRoot, nil)
+				if err != nil {
+					return false, err
+				}
+				pInput.TaprootKeySpendSig = signature
+				signed = true
+			}
+		}
+
+		xOnlyPubKey := schnorr.SerializePubKey(pubKey)
+		for _, leafScript := range pInput.TaprootLeafScript {
+			tapLeaf := txscript.NewTapLeaf(leafScript.LeafVersion, leafScript.Script)
+			leafHash := tapLeaf.TapHash()
+			if !scriptHasKey(leafScript.Script, xOnlyPubKey) || findTaprootScriptSpendSig(pInput, xOnlyPubKey, leafHash[:]) != nil {
+				continue
+			}
+
+			signature, err := signTaproot(ctx, signer, nil, &tapLeaf)
+			if err != nil {
+				return false, err
+			}
+			// sighash byte is SigHash field, BIP371 signature is 64 bytes
+			pInput.TaprootScriptSpendSig = append(pInput.TaprootScriptSpendSig, &psbt.TaprootScriptSpendSig{
+				XOnlyPubKey: xOnlyPubKey,
+				LeafHash:    leafHash[:],
+				Signature:   signature[:schnorr.SignatureSize],
+				SigHash:     ctx.SigHashType,
+			})
+			signed = true
+		}
+	}
+
+	return signed, nil
+}
+
+// finalPSBTInputScripts are scriptSig and witness of pInput built of its partial signatures,
+// errNotEnoughSignatures if they don't satisfy the script
+func finalPSBTInputScripts(pInput *psbt.PInput, prevOut *wire.TxOut) ([]byte, wire.TxWitness, error) {
+	if txscript.IsPayToTaproot(prevOut.PkScript) {
+		witness, err := finalPSBTTaprootWitness(pInput)
+		return nil, witness, err
+	}
+
+	scriptCode, isWitness, err := psbtScriptCode(pInput, prevOut)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// <sig> <pubkey>, <sig>, or <empty> <sigs...>
+	var stack [][]byte
+	switch class := txscript.GetScriptClass(scriptCode); class {
+	case txscript.WitnessV0PubKeyHashTy, txscript.PubKeyHashTy:
+		partialSig := findPartialSigOfHash(pInput, scriptCode)
+		if partialSig == nil {
+			return nil, nil, errNotEnoughSignatures
+		}
+		stack = [][]byte{partialSig.Signature, partialSig.PubKey}
+
+	case txscript.PubKeyTy:
+		pubKeys, err := txscript.PushedData(scriptCode)
+		if err != nil {
+			return nil, nil, err
+		}
+		partialSig := findPartialSig(pInput, pubKeys[0])
+		if partialSig == nil {
+			return nil, nil, errNotEnoughSignatures
+		}
+		stack = [][]byte{partialSig.Signature}
+
+	case txscript.MultiSigTy:
+		signatures, err := multiSigSignatures(scriptCode, func(pubKey []byte) ([]byte, error) {
+			if partialSig := findPartialSig(pInput, pubKey); partialSig != nil {
+				return partialSig.Signature, nil
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		stack = append([][]byte{nil}, signatures...)
+
+	default:
+		return nil, nil, errors.Wrapf(ErrInvalidTxIn, "can't finalize %s script", class)
+	}
+
+	if !isWitness {
+		// P2SH scriptSig ends with redeem script
+		builder := txscript.NewScriptBuilder()
+		for _, item := range stack {
+			if item == nil {
+				builder.AddOp(txscript.OP_0)
+				continue
+			}
+			builder.AddData(item)
+		}
+		if pInput.RedeemScript != nil {
+			builder.AddData(pInput.RedeemScript)
+		}
+
+		signatureScript, err := builder.Script()
+		return signatureScript, nil, err
+	}
+
+	// P2WSH witness ends with witness script, and nested segwit scriptSig is the witness program
+	witness := wire.TxWitness(stack)
+	if pInput.WitnessScript != nil && bytes.Equal(scriptCode, pInput.WitnessScript) {
+		witness = append(witness, scriptCode)
+	}
+
+	var signatureScript []byte
+	if pInput.RedeemScript != nil {
+		signatureScript, err = txscript.NewScriptBuilder().AddData(pInput.RedeemScript).Script()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return signatureScript, witness, nil
+}
+
+// finalPSBTTaprootWitness is key-path signature, or the first leaf signed by all of its keys:
+// <sigs...> <leaf script> <control block>, signature of the first key is the top of the stack
+func finalPSBTTaprootWitness(pInput *psbt.PInput) (wire.TxWitness, error) {
+	if pInput.TaprootKeySpendSig != nil {
+		return wire.TxWitness{pInput.TaprootKeySpendSig}, nil
+	}
+
+	for _, leafScript := range pInput.TaprootLeafScript {
+		tapLeaf := txscript.NewTapLeaf(leafScript.LeafVersion, leafScript.Script)
+		leafHash := tapLeaf.TapHash()
+
+		pushes, err := txscript.PushedData(leafScript.Script)
+		if err != nil {
+			return nil, err
+		}
+
+		var signatures [][]byte
+		satisfied := true
+		for _, push := range pushes {
+			if len(push) != schnorr.PubKeyBytesLen {
+				continue
+			}
+			sig := findTaprootScriptSpendSig(pInput, push, leafHash[:])
+			if sig == nil {
+				satisfied = false
+				break
+			}
+			// sighash byte of SigHash, unless it's SIGHASH_DEFAULT
+			signature := sig.Signature
+			if len(signature) == schnorr.SignatureSize && sig.SigHash != txscript.SigHashDefault {
+				signature = append(signature[:len(signature):len(signature)], byte(sig.SigHash))
+			}
+			signatures = append([][]byte{signature}, signatures...)
+		}
+		if !satisfied || len(signatures) == 0 {
+			continue
+		}
+
+		return append(signatures, leafScript.Script, leafScript.ControlBlock), nil
+	}
+
+	return nil, errNotEnoughSignatures
+}
+
+// scriptHasKey says whether script pushes pubKey or its hash
+func scriptHasKey(script []byte, pubKey []byte) bool {
+	pushes, err := txscript.PushedData(script)
+	if err != nil {
+		return false
+	}
+
+	pubKeyHash := btcutil.Hash160(pubKey)
+	for _, push := range pushes {
+		if bytes.Equal(push, pubKey) || bytes.Equal(push, pubKeyHash) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func findPartialSig(pInput *psbt.PInput, pubKey []byte) *psbt.PartialSig {
+	for _, partialSig := range pInput.PartialSigs {
+		if bytes.Equal(partialSig.PubKey, pubKey) {
+			return partialSig
+		}
+	}
+
+	return nil
+}
+
+// findPartialSigOfHash is partial signature of the key hashed in P2PKH or P2WPKH script
+func findPartialSigOfHash(pInput *psbt.PInput, script []byte) *psbt.PartialSig {
+	for _, partialSig := range pInput.PartialSigs {
+		if scriptHasKey(script, partialSig.PubKey) {
+			return partialSig
+		}
+	}
+
+	return nil
+}
+
+func findTaprootScriptSpendSig(pInput *psbt.PInput, xOnlyPubKey, leafHash []byte) *psbt.TaprootScriptSpendSig {
+	for _, sig := range pInput.TaprootScriptSpendSig {
+		if bytes.Equal(sig.XOnlyPubKey, xOnlyPubKey) && bytes.Equal(sig.LeafHash, leafHash) {
+			return sig
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package tx_forge
+
+import (
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestSignPSBT(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+	}
+
+	wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	pkScriptP2PKH := payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey1), testParams.Network))
+	witnessProgram, err := GetWitnessProgramFromPrivateKey(wifPrivateKey1, testParams.Network)
+	require.NoError(t, err)
+	pkScriptP2SHP2WPKH := payToAddr(btcutil.NewAddressScriptHash(witnessProgram, testParams.Network))
+
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+	multiSigScriptHash := sha256.Sum256(multiSigScript)
+	pkScriptP2WSH := payToAddr(btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network))
+	pkScriptP2SHP2WSH := payToAddr(btcutil.NewAddressScriptHash(pkScriptP2WSH, testParams.Network))
+	pkScriptP2SHMultiSig := payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network))
+
+	tapTree := generateTapTree(t, wifPrivateKey1, wifPrivateKey2, testParams.Network)
+	pkScriptP2TR := tapTree.PkScript
+
+	prevTx := wire.NewMsgTx(wire.TxVersion)
+	prevTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	prevTx.AddTxOut(wire.NewTxOut(100000, pkScriptP2PKH))
+
+	// inputs of every builtin unlocker, without private keys
+	generateTxIns := func() []ForgeTxIn {
+		txIns := []ForgeTxIn{
+			generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, nil),
+			generateTxIn(prevTxId1, 1, 100000, pkScriptP2SHP2WPKH, nil),
+			generateTxIn(prevTxId1, 2, 100000, pkScriptP2WSH, nil),
+			generateTxIn(prevTxId1, 3, 100000, pkScriptP2SHP2WSH, nil),
+			generateTxIn(prevTxId1, 4, 100000, pkScriptP2SHMultiSig, nil),
+			generateTxIn(prevTxId1, 5, 100000, pkScriptP2TR, nil),
+			generateTxIn(prevTxId1, 6, 100000, pkScriptP2TR, nil),
+			generateTxIn(prevTx.TxHash().String(), 0, 100000, pkScriptP2PKH, nil),
+			generateTxIn(prevTxId1, 8, 100000, pkScriptP2PKH, nil),
+		}
+		txIns[1].Bip32Derivation = []*psbt.Bip32Derivation{{PubKey: pubKey1}}
+		txIns[2].WitnessScript = multiSigScript
+		txIns[3].WitnessScript = multiSigScript
+		txIns[4].RedeemScript = multiSigScript
+		txIns[5].TaprootMerkleRoot = tapTree.MerkleRoot
+		txIns[6].TapScript = &TapScriptSpend{LeafScript: tapTree.LeafScript, ControlBlock: tapTree.ControlBlock}
+		txIns[7].PrevTx = prevTx
+		return txIns
+	}
+	txOuts := []ForgeTxOut{{Value: 500000, Address: p2sh1}}
+
+	t.Run("ok", func(t *testing.T) {
+		txIns := generateTxIns()
+		// script-path estimate counts signature of the leaf key only if it's set
+		txIns[6].WIFPrivKey = wifPrivateKey2
+		packet, sumResult, err := ForgePSBT(txIns, txOuts, testParams)
+		require.NoError(t, err)
+
+		// the first signer has key 1 only, multisig and script-path inputs are left
+		signed, err := SignPSBT(packet, WIFSigners(wifPrivateKey1))
+		require.NoError(t, err)
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 7, 8}, signed)
+		require.NoError(t, FinalizePSBT(packet))
+		assert.False(t, packet.IsComplete())
+		for i, pInput := range packet.Inputs {
+			finalized := pInput.FinalScriptSig != nil || pInput.FinalScriptWitness != nil
+			assert.Equal(t, i != 2 && i != 3 && i != 4 && i != 6, finalized, "txin %d", i)
+		}
+		assert.Empty(t, packet.Inputs[0].PartialSigs)
+		assert.Len(t, packet.Inputs[2].PartialSigs, 1)
+
+		_, err = ExtractPSBT(packet)
+		require.Error(t, err)
+
+		// the second signer doesn't sign finalized inputs again
+		signed, err = SignPSBT(packet, WIFSigners(wifPrivateKey2, wifPrivateKey1))
+		require.NoError(t, err)
+		assert.Equal(t, []int{2, 3, 4, 6}, signed)
+		assert.Len(t, packet.Inputs[2].PartialSigs, 2)
+		require.NoError(t, FinalizePSBT(packet))
+		assert.True(t, packet.IsComplete())
+
+		tx, err := ExtractPSBT(packet)
+		require.NoError(t, err)
+		assert.Equal(t, packet.UnsignedTx.TxOut, tx.TxOut)
+		for i := range tx.TxIn {
+			assert.Equal(t, packet.UnsignedTx.TxIn[i].PreviousOutPoint, tx.TxIn[i].PreviousOutPoint)
+		}
+		assert.LessOrEqual(t, vSize(tx), sumResult.VSize)
+		assert.GreaterOrEqual(t, vSize(tx), sumResult.VSize-4*len(txIns))
+
+		// it's the same tx ForgeTx signs with the keys
+		txIns = generateTxIns()
+		txIns[0].WIFPrivKey = wifPrivateKey1
+		txIns[1].WIFPrivKey = wifPrivateKey1
+		for i := 2; i < 5; i++ {
+			txIns[i].WIFPrivKeys = []*btcutil.WIF{wifPrivateKey1, wifPrivateKey2}
+		}
+		txIns[5].WIFPrivKey = wifPrivateKey1
+		txIns[6].WIFPrivKey = wifPrivateKey2
+		txIns[7].WIFPrivKey = wifPrivateKey1
+		txIns[8].WIFPrivKey = wifPrivateKey1
+		signParams := *testParams
+		signParams.NeedToSign = true
+		forgedTx, _, err := ForgeTx(txIns, txOuts, &signParams)
+		require.NoError(t, err)
+		require.Len(t, forgedTx.TxIn, len(tx.TxIn))
+		for i := range tx.TxIn {
+			assert.Equal(t, len(forgedTx.TxIn[i].Witness), len(tx.TxIn[i].Witness), "txin %d", i)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		testcases := []struct {
+			name   string
+			mutate func(packet *psbt.Packet)
+			sign   bool
+		}{
+			{
+				name: "input without utxo",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[0].WitnessUtxo = nil
+				},
+				sign: true,
+			},
+			{
+				name: "NonWitnessUtxo isn't tx of input",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[7].NonWitnessUtxo = wire.NewMsgTx(wire.TxVersion)
+				},
+				sign: true,
+			},
+			{
+				name: "redeem script is missing",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[4].RedeemScript = nil
+				},
+				sign: true,
+			},
+			{
+				name: "signature of another tx",
+				mutate: func(packet *psbt.Packet) {
+					packet.UnsignedTx.TxOut[0].Value--
+				},
+			},
+			{
+				name: "signature of another key",
+				mutate: func(packet *psbt.Packet) {
+					packet.Inputs[0].PartialSigs[0].PubKey = wifPrivateKey2.SerializePubKey()
+					packet.Inputs[0].WitnessUtxo = wire.NewTxOut(100000, generateP2WPKHPkScript(t, wifPrivateKey2, testParams.Network))
+				},
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				packet, _, err := ForgePSBT(generateTxIns(), txOuts, testParams)
+				require.NoError(t, err)
+
+				if tc.sign {
+					tc.mutate(packet)
+					_, err = SignPSBT(packet, WIFSigners(wifPrivateKey1, wifPrivateKey2))
+					require.ErrorIs(t, err, ErrInvalidTxIn)
+					return
+				}
+
+				_, err = SignPSBT(packet, WIFSigners(wifPrivateKey1, wifPrivateKey2))
+				require.NoError(t, err)
+				tc.mutate(packet)
+				require.Error(t, FinalizePSBT(packet))
+			})
+		}
+	})
+
+	t.Run("non-default sighash round trip", func(t *testing.T) {
+		txIns := generateTxIns()
+		for i := range txIns {
+			txIns[i].SigHashType = txscript.SigHashAll
+		}
+		txIns[6].WIFPrivKey = wifPrivateKey2
+		packet, _, err := ForgePSBT(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		_, err = SignPSBT(packet, WIFSigners(wifPrivateKey1, wifPrivateKey2))
+		require.NoError(t, err)
+
+		// signer hands the packet off to finalizer
+		b64, err := packet.B64Encode()
+		require.NoError(t, err)
+		parsed, err := psbt.NewFromRawBytes(strings.NewReader(b64), true)
+		require.NoError(t, err)
+		require.Len(t, parsed.Inputs[6].TaprootScriptSpendSig, 1)
+		assert.Len(t, parsed.Inputs[6].TaprootScriptSpendSig[0].Signature, schnorr.SignatureSize)
+		assert.Equal(t, txscript.SigHashAll, parsed.Inputs[6].TaprootScriptSpendSig[0].SigHash)
+
+		require.NoError(t, FinalizePSBT(parsed))
+		tx, err := ExtractPSBT(parsed)
+		require.NoError(t, err)
+		for _, i := range []int{5, 6} {
+			require.Len(t, tx.TxIn[i].Witness[0], schnorr.SignatureSize+1, "txin %d", i)
+			assert.Equal(t, byte(txscript.SigHashAll), tx.TxIn[i].Witness[0][schnorr.SignatureSize], "txin %d", i)
+		}
+	})
+
+	t.Run("extract verifies final scripts", func(t *testing.T) {
+		packet, _, err := ForgePSBT(generateTxIns(), txOuts, testParams)
+		require.NoError(t, err)
+		_, err = SignPSBT(packet, WIFSigners(wifPrivateKey1, wifPrivateKey2))
+		require.NoError(t, err)
+		require.NoError(t, FinalizePSBT(packet))
+
+		packet.Inputs[8].FinalScriptSig = packet.Inputs[7].FinalScriptSig
+		_, err = ExtractPSBT(packet)
+		require.Error(t, err)
+	})
+
+}
@@ -0,0 +1,191 @@
+package tx_forge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestForgePSBT(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+	}
+	pkScriptP2SH, err := hex.DecodeString("a91490c6addad6abcb929b6edd2833397aed1b5c6f5e87")
+	require.NoError(t, err)
+
+	wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+	derivation := func(wif *btcutil.WIF, index uint32) []*psbt.Bip32Derivation {
+		return []*psbt.Bip32Derivation{{PubKey: wif.SerializePubKey(), MasterKeyFingerprint: 0xdeadbeef, Bip32Path: []uint32{84 | 1<<31, 1 | 1<<31, 1 << 31, 0, index}}}
+	}
+
+	testParams.ChangeBip32Derivation = derivation(wifPrivateKey2, 100)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	pkScriptP2PKH := payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey1), testParams.Network))
+
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+	multiSigScriptHash := sha256.Sum256(multiSigScript)
+	pkScriptP2WSH := payToAddr(btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network))
+	pkScriptP2SHP2WSH := payToAddr(btcutil.NewAddressScriptHash(pkScriptP2WSH, testParams.Network))
+	pkScriptP2SHMultiSig := payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network))
+
+	tapTree := generateTapTree(t, wifPrivateKey1, wifPrivateKey2, testParams.Network)
+	pkScriptP2TR := tapTree.PkScript
+
+	// prevTx of p2pkh utxo, for legacy input
+	prevTx := wire.NewMsgTx(wire.TxVersion)
+	prevTx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{1}, 0), nil, nil))
+	prevTx.AddTxOut(wire.NewTxOut(50000, pkScriptP2SH))
+	prevTx.AddTxOut(wire.NewTxOut(100000, pkScriptP2PKH))
+
+	t.Run("ok", func(t *testing.T) {
+		txIns := []ForgeTxIn{
+			generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, nil),
+			generateTxIn(prevTxId1, 1, 100000, pkScriptP2SH, nil),
+			generateTxIn(prevTxId1, 2, 100000, pkScriptP2WSH, nil),
+			generateTxIn(prevTxId1, 3, 100000, pkScriptP2SHP2WSH, nil),
+			generateTxIn(prevTxId1, 4, 100000, pkScriptP2SHMultiSig, nil),
+			generateTxIn(prevTxId1, 5, 100000, pkScriptP2TR, wifPrivateKey1),
+			generateTxIn(prevTxId1, 6, 100000, pkScriptP2TR, nil),
+			generateTxIn(prevTx.TxHash().String(), 1, 100000, pkScriptP2PKH, nil),
+		}
+		txIns[0].Bip32Derivation = derivation(wifPrivateKey1, 0)
+		txIns[1].Bip32Derivation = derivation(wifPrivateKey1, 1)
+		txIns[2].WitnessScript = multiSigScript
+		txIns[3].WitnessScript = multiSigScript
+		txIns[4].RedeemScript = multiSigScript
+		txIns[5].TaprootMerkleRoot = tapTree.MerkleRoot
+		txIns[5].Bip32Derivation = derivation(wifPrivateKey1, 5)
+		txIns[6].TapScript = &TapScriptSpend{LeafScript: tapTree.LeafScript, ControlBlock: tapTree.ControlBlock}
+		txIns[6].Bip32Derivation = derivation(wifPrivateKey2, 6)
+		txIns[7].PrevTx = prevTx
+
+		txOuts := []ForgeTxOut{{Value: 500000, Address: p2sh1, Bip32Derivation: derivation(wifPrivateKey3, 7)}}
+
+		packet, sumResult, err := ForgePSBT(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		require.NoError(t, packet.SanityCheck())
+		assert.False(t, packet.IsComplete())
+
+		// it's the tx ForgeTx would forge, with change, and fee is estimated
+		estimation, err := EstimateTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		assert.Equal(t, estimation, sumResult)
+		fee, err := packet.GetTxFee()
+		require.NoError(t, err)
+		assert.Equal(t, sumResult.Fee, int(fee))
+
+		require.Len(t, packet.Inputs, len(txIns))
+		for i, pInput := range packet.Inputs[:7] {
+			require.NotNil(t, pInput.WitnessUtxo, "txin %d", i)
+			assert.Equal(t, int64(txIns[i].Utxo.Value), pInput.WitnessUtxo.Value)
+			assert.Equal(t, txIns[i].Utxo.PubKeyScript, pInput.WitnessUtxo.PkScript)
+		}
+
+		assert.Equal(t, txIns[0].Bip32Derivation, packet.Inputs[0].Bip32Derivation)
+
+		wantRedeemScript, err := GetWitnessProgramFromPrivateKey(wifPrivateKey1, testParams.Network)
+		require.NoError(t, err)
+		assert.Equal(t, wantRedeemScript, packet.Inputs[1].RedeemScript)
+		assert.Equal(t, txIns[1].Bip32Derivation, packet.Inputs[1].Bip32Derivation)
+
+		assert.Equal(t, multiSigScript, packet.Inputs[2].WitnessScript)
+		assert.Nil(t, packet.Inputs[2].RedeemScript)
+
+		assert.Equal(t, multiSigScript, packet.Inputs[3].WitnessScript)
+		assert.Equal(t, pkScriptP2WSH, packet.Inputs[3].RedeemScript)
+
+		assert.Equal(t, multiSigScript, packet.Inputs[4].RedeemScript)
+
+		assert.Equal(t, tapTree.MerkleRoot, packet.Inputs[5].TaprootMerkleRoot)
+		assert.Equal(t, schnorr.SerializePubKey(wifPrivateKey1.PrivKey.PubKey()), packet.Inputs[5].TaprootInternalKey)
+		require.Len(t, packet.Inputs[5].TaprootBip32Derivation, 1)
+		assert.Equal(t, pubKey1[1:], packet.Inputs[5].TaprootBip32Derivation[0].XOnlyPubKey)
+		assert.Empty(t, packet.Inputs[5].TaprootBip32Derivation[0].LeafHashes)
+
+		require.Len(t, packet.Inputs[6].TaprootLeafScript, 1)
+		assert.Equal(t, tapTree.LeafScript, packet.Inputs[6].TaprootLeafScript[0].Script)
+		assert.Equal(t, tapTree.ControlBlock, packet.Inputs[6].TaprootLeafScript[0].ControlBlock)
+		assert.Equal(t, schnorr.SerializePubKey(wifPrivateKey1.PrivKey.PubKey()), packet.Inputs[6].TaprootInternalKey)
+		require.Len(t, packet.Inputs[6].TaprootBip32Derivation, 1)
+		leafHash := txscript.NewBaseTapLeaf(tapTree.LeafScript).TapHash()
+		assert.Equal(t, [][]byte{leafHash[:]}, packet.Inputs[6].TaprootBip32Derivation[0].LeafHashes)
+
+		assert.Equal(t, prevTx, packet.Inputs[7].NonWitnessUtxo)
+		assert.Nil(t, packet.Inputs[7].WitnessUtxo)
+
+		require.Len(t, packet.Outputs, 2)
+		assert.Equal(t, txOuts[0].Bip32Derivation, packet.Outputs[0].Bip32Derivation)
+		assert.Equal(t, testParams.ChangeBip32Derivation, packet.Outputs[1].Bip32Derivation)
+		assert.Equal(t, int64(sumResult.Change), packet.UnsignedTx.TxOut[1].Value)
+
+		// it's handed off serialized
+		var buf bytes.Buffer
+		require.NoError(t, packet.Serialize(&buf))
+		parsed, err := psbt.NewFromRawBytes(bytes.NewReader(buf.Bytes()), false)
+		require.NoError(t, err)
+		var parsedBuf bytes.Buffer
+		require.NoError(t, parsed.Serialize(&parsedBuf))
+		assert.Equal(t, buf.Bytes(), parsedBuf.Bytes())
+		assert.Equal(t, packet.UnsignedTx.TxHash(), parsed.UnsignedTx.TxHash())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		txOuts := []ForgeTxOut{{Value: 50000, Address: p2sh1}}
+
+		wrongPrevTx := prevTx.Copy()
+		wrongPrevTx.TxOut[1].Value++
+
+		testcases := []struct {
+			name string
+			txIn ForgeTxIn
+		}{
+			{
+				name: "p2sh-p2wpkh without pubkey",
+				txIn: generateTxIn(prevTxId1, 0, 100000, pkScriptP2SH, nil),
+			},
+			{
+				name: "p2sh-p2wpkh with pubkey of another key",
+				txIn: ForgeTxIn{
+					Utxo:            UTXO{TxID: prevTxId1, Value: 100000, PubKeyScript: pkScriptP2SH},
+					Bip32Derivation: derivation(wifPrivateKey2, 0),
+				},
+			},
+			{
+				name: "prevTx isn't tx of utxo",
+				txIn: ForgeTxIn{
+					Utxo:   UTXO{TxID: prevTxId1, Vout: 1, Value: 100000, PubKeyScript: pkScriptP2PKH},
+					PrevTx: prevTx,
+				},
+			},
+			{
+				name: "prevTx output isn't utxo",
+				txIn: ForgeTxIn{
+					Utxo:   UTXO{TxID: wrongPrevTx.TxHash().String(), Vout: 1, Value: 100000, PubKeyScript: pkScriptP2PKH},
+					PrevTx: wrongPrevTx,
+				},
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				_, _, err := ForgePSBT([]ForgeTxIn{tc.txIn}, txOuts, testParams)
+				require.ErrorIs(t, err, ErrInvalidTxIn)
+			})
+		}
+	})
+}
@@ -0,0 +1,592 @@
+package tx_forge
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"io"
+	"sort"
+)
+
+// PSBTModifiable are BIP370 flags of what constructors may still add to the packet
+type PSBTModifiable uint8
+
+const (
+	PSBTInputsModifiable PSBTModifiable = 1 << iota
+	PSBTOutputsModifiable
+	// PSBTHasSigHashSingle is set if some signature commits to the output of the same index as its input
+	PSBTHasSigHashSingle
+)
+
+// BIP370 key types, which are the unsigned tx of v0 packet
+const (
+	psbtGlobalUnsignedTx       = 0x00
+	psbtGlobalTxVersion        = 0x02
+	psbtGlobalFallbackLockTime = 0x03
+	psbtGlobalInputCount       = 0x04
+	psbtGlobalOutputCount      = 0x05
+	psbtGlobalTxModifiable     = 0x06
+	psbtGlobalVersion          = 0xfb
+
+	psbtInPreviousTxID           = 0x0e
+	psbtInOutputIndex            = 0x0f
+	psbtInSequence               = 0x10
+	psbtInRequiredTimeLockTime   = 0x11
+	psbtInRequiredHeightLockTime = 0x12
+
+	psbtOutAmount = 0x03
+	psbtOutScript = 0x04
+)
+
+// PSBTInputLockTime is lock time tx needs for an input to be spent, 0 if there's none of the type
+type PSBTInputLockTime struct {
+	Time   uint32 `json:"time,omitempty"`   // unix time, at least txscript.LockTimeThreshold
+	Height uint32 `json:"height,omitempty"` // block height, below txscript.LockTimeThreshold
+}
+
+// PSBTv2 is BIP370 packet, inputs and outputs of which are added after creation by constructors
+type PSBTv2 struct {
+	// Packet is v0 view of the packet, signers, finalizers and combiners work with it as they are.
+	// Its UnsignedTx.LockTime is computed of FallbackLockTime and InputLockTimes
+	Packet *psbt.Packet
+	// FallbackLockTime is lock time of tx if no input requires one, 0 if it's nil
+	FallbackLockTime *uint32
+	// TxModifiable are flags set by creator, signatures restrict them further, see Modifiable
+	TxModifiable PSBTModifiable
+	// InputLockTimes are in order of Packet.Inputs, missing ones require no lock time
+	InputLockTimes []PSBTInputLockTime
+}
+
+const lockTimeThreshold uint32 = txscript.LockTimeThreshold
+
+type psbtKeyValue struct {
+	key   []byte
+	value []byte
+}
+
+// NewPSBTv2 is v2 packet of v0 one, e.g. made by ForgePSBT, modifiable by constructors as flags say.
+// Non-zero lock time of v0 packet is the fallback one
+func NewPSBTv2(packet *psbt.Packet, modifiable PSBTModifiable) *PSBTv2 {
+	p := &PSBTv2{
+		Packet:       packet,
+		TxModifiable: modifiable,
+	}
+	if lockTime := packet.UnsignedTx.LockTime; lockTime != 0 {
+		p.FallbackLockTime = &lockTime
+	}
+
+	return p
+}
+
+// ParsePSBTv2 reads BIP370 packet serialized by Serialize, base64 encoded if b64 is set
+func ParsePSBTv2(r io.Reader, b64 bool) (*PSBTv2, error) {
+	if b64 {
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	var magic [5]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic[:], []byte("psbt\xff")) {
+		return nil, psbt.ErrInvalidMagicBytes
+	}
+
+	globals, err := readPSBTMap(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "globals")
+	}
+
+	p := &PSBTv2{}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	var version, inputCount, outputCount *uint64
+	hasTxVersion := false
+	var v0Globals []psbtKeyValue
+	for _, kv := range globals {
+		switch kv.key[0] {
+		case psbtGlobalUnsignedTx:
+			return nil, errors.New("v2 packet can't have unsigned tx")
+		case psbtGlobalTxVersion:
+			if len(kv.value) != 4 {
+				return nil, errors.New("tx version isn't 4 bytes")
+			}
+			tx.Version = int32(binary.LittleEndian.Uint32(kv.value))
+			hasTxVersion = true
+		case psbtGlobalFallbackLockTime:
+			if len(kv.value) != 4 {
+				return nil, errors.New("fallback lock time isn't 4 bytes")
+			}
+			fallbackLockTime := binary.LittleEndian.Uint32(kv.value)
+			p.FallbackLockTime = &fallbackLockTime
+		case psbtGlobalInputCount:
+			inputCount, err = readCompactSize(kv.value)
+		case psbtGlobalOutputCount:
+			outputCount, err = readCompactSize(kv.value)
+		case psbtGlobalTxModifiable:
+			if len(kv.value) != 1 {
+				return nil, errors.New("tx modifiable flags aren't 1 byte")
+			}
+			p.TxModifiable = PSBTModifiable(kv.value[0])
+		case psbtGlobalVersion:
+			if len(kv.value) != 4 {
+				return nil, errors.New("version isn't 4 bytes")
+			}
+			v := uint64(binary.LittleEndian.Uint32(kv.value))
+			version = &v
+		default:
+			v0Globals = append(v0Globals, kv)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "global %x", kv.key)
+		}
+	}
+	if version == nil || *version != 2 {
+		return nil, errors.New("packet isn't version 2")
+	}
+	if !hasTxVersion {
+		return nil, errors.New("tx version is missing")
+	}
+	if inputCount == nil || outputCount == nil {
+		return nil, errors.New("input or output count is missing")
+	}
+	// it's to not allocate much for a broken packet, standard tx can't have so many
+	if *inputCount > maxStandardTxWeight || *outputCount > maxStandardTxWeight {
+		return nil, errors.New("too many inputs or outputs")
+	}
+
+	v0Inputs := make([][]psbtKeyValue, *inputCount)
+	p.InputLockTimes = make([]PSBTInputLockTime, *inputCount)
+	for i := range v0Inputs {
+		kvs, err := readPSBTMap(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "txin %d", i)
+		}
+
+		txIn := wire.NewTxIn(&wire.OutPoint{}, nil, nil)
+		var hasTxID, hasIndex bool
+		for _, kv := range kvs {
+			switch kv.key[0] {
+			case psbtInPreviousTxID:
+				if len(kv.value) != chainhash.HashSize {
+					return nil, errors.Errorf("txin %d: previous txid isn't %d bytes", i, chainhash.HashSize)
+				}
+				copy(txIn.PreviousOutPoint.Hash[:], kv.value)
+				hasTxID = true
+			case psbtInOutputIndex, psbtInSequence, psbtInRequiredTimeLockTime, psbtInRequiredHeightLockTime:
+				if len(kv.value) != 4 {
+					return nil, errors.Errorf("txin %d: field %x isn't 4 bytes", i, kv.key)
+				}
+				value := binary.LittleEndian.Uint32(kv.value)
+				switch kv.key[0] {
+				case psbtInOutputIndex:
+					txIn.PreviousOutPoint.Index = value
+					hasIndex = true
+				case psbtInSequence:
+					txIn.Sequence = value
+				case psbtInRequiredTimeLockTime:
+					p.InputLockTimes[i].Time = value
+				case psbtInRequiredHeightLockTime:
+					p.InputLockTimes[i].Height = value
+				}
+			default:
+				v0Inputs[i] = append(v0Inputs[i], kv)
+			}
+		}
+		if !hasTxID || !hasIndex {
+			return nil, errors.Errorf("txin %d: previous outpoint is missing", i)
+		}
+		if err := p.InputLockTimes[i].validate(); err != nil {
+			return nil, errors.Wrapf(err, "txin %d", i)
+		}
+		tx.AddTxIn(txIn)
+	}
+
+	v0Outputs := make([][]psbtKeyValue, *outputCount)
+	for i := range v0Outputs {
+		kvs, err := readPSBTMap(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "txout %d", i)
+		}
+
+		txOut := wire.NewTxOut(0, nil)
+		var hasAmount, hasScript bool
+		for _, kv := range kvs {
+			switch kv.key[0] {
+			case psbtOutAmount:
+				if len(kv.value) != 8 {
+					return nil, errors.Errorf("txout %d: amount isn't 8 bytes", i)
+				}
+				txOut.Value = int64(binary.LittleEndian.Uint64(kv.value))
+				hasAmount = true
+			case psbtOutScript:
+				txOut.PkScript = kv.value
+				hasScript = true
+			default:
+				v0Outputs[i] = append(v0Outputs[i], kv)
+			}
+		}
+		if !hasAmount || !hasScript {
+			return nil, errors.Errorf("txout %d: amount or script is missing", i)
+		}
+		tx.AddTxOut(txOut)
+	}
+
+	tx.LockTime, err = p.lockTime(p.InputLockTimes)
+	if err != nil {
+		return nil, err
+	}
+
+	// the rest is v0 packet, parsed as it is
+	var unsignedTx bytes.Buffer
+	if err := tx.SerializeNoWitness(&unsignedTx); err != nil {
+		return nil, err
+	}
+	v0Globals = append([]psbtKeyValue{{key: []byte{psbtGlobalUnsignedTx}, value: unsignedTx.Bytes()}}, v0Globals...)
+
+	var v0 bytes.Buffer
+	if err := writePSBTMaps(&v0, v0Globals, v0Inputs, v0Outputs); err != nil {
+		return nil, err
+	}
+	p.Packet, err = psbt.NewFromRawBytes(&v0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Modifiable are TxModifiable flags restricted by signatures: inputs can't be added if some signature commits to
+// all of them, i.e. it isn't SIGHASH_ANYONECANPAY, outputs can't be added if some is neither SIGHASH_NONE nor SIGHASH_SINGLE.
+// Finalized inputs restrict both
+func (p *PSBTv2) Modifiable() PSBTModifiable {
+	modifiable := p.TxModifiable
+	for _, pInput := range p.Packet.Inputs {
+		if pInput.FinalScriptSig != nil || pInput.FinalScriptWitness != nil {
+			modifiable &^= PSBTInputsModifiable | PSBTOutputsModifiable
+			continue
+		}
+
+		for _, sigHashType := range psbtInputSigHashTypes(&pInput) {
+			if sigHashType&txscript.SigHashAnyOneCanPay == 0 {
+				modifiable &^= PSBTInputsModifiable
+			}
+			switch sigHashType &^ txscript.SigHashAnyOneCanPay {
+			case txscript.SigHashNone:
+			case txscript.SigHashSingle:
+				modifiable |= PSBTHasSigHashSingle
+			default:
+				modifiable &^= PSBTOutputsModifiable
+			}
+		}
+	}
+
+	return modifiable
+}
+
+// AddInput is constructor adding txin after the existing inputs, if they're modifiable.
+// Lock time of tx is recomputed, lockTime of txin can't be the other type than ones of existing inputs
+func (p *PSBTv2) AddInput(txin ForgeTxIn, lockTime PSBTInputLockTime, network *chaincfg.Params) error {
+	if p.Modifiable()&PSBTInputsModifiable == 0 {
+		return errors.Wrap(ErrInvalidParams, "inputs aren't modifiable")
+	}
+	if err := lockTime.validate(); err != nil {
+		return err
+	}
+
+	outPoints := make(map[wire.OutPoint]*wire.TxOut)
+	txIn, err := createTxIn(&txin, outPoints)
+	if err != nil {
+		return err
+	}
+	for _, existing := range p.Packet.UnsignedTx.TxIn {
+		if existing.PreviousOutPoint == txIn.PreviousOutPoint {
+			return errors.Wrapf(ErrInvalidTxIn, "input %s is already in tx", txIn.PreviousOutPoint)
+		}
+	}
+
+	var pInput psbt.PInput
+	if err := fillPSBTInput(&pInput, &txin, network); err != nil {
+		return err
+	}
+
+	inputLockTimes := append(p.inputLockTimes(), lockTime)
+	txLockTime, err := p.lockTime(inputLockTimes)
+	if err != nil {
+		return err
+	}
+
+	p.Packet.UnsignedTx.AddTxIn(txIn)
+	p.Packet.UnsignedTx.LockTime = txLockTime
+	p.Packet.Inputs = append(p.Packet.Inputs, pInput)
+	p.InputLockTimes = inputLockTimes
+
+	return nil
+}
+
+// AddOutput is constructor adding txout after the existing outputs, if they're modifiable
+func (p *PSBTv2) AddOutput(txout ForgeTxOut, network *chaincfg.Params) error {
+	if p.Modifiable()&PSBTOutputsModifiable == 0 {
+		return errors.Wrap(ErrInvalidParams, "outputs aren't modifiable")
+	}
+
+	pkScript, err := txout.locker().LockingScript(network)
+	if err != nil {
+		return err
+	}
+
+	p.Packet.UnsignedTx.AddTxOut(wire.NewTxOut(int64(txout.Value), pkScript))
+	p.Packet.Outputs = append(p.Packet.Outputs, psbt.POutput{Bip32Derivation: txout.Bip32Derivation})
+
+	return nil
+}
+
+// Serialize writes BIP370 packet: v0 one with the unsigned tx split into fields of globals, inputs and outputs
+func (p *PSBTv2) Serialize(w io.Writer) error {
+	var v0 bytes.Buffer
+	if err := p.Packet.Serialize(&v0); err != nil {
+		return err
+	}
+
+	// magic is checked by v0 parser, the rest are maps of v0 packet
+	if _, err := io.CopyN(io.Discard, &v0, 5); err != nil {
+		return err
+	}
+	v0Globals, err := readPSBTMap(&v0)
+	if err != nil {
+		return err
+	}
+
+	tx := p.Packet.UnsignedTx
+	globals := []psbtKeyValue{
+		{key: []byte{psbtGlobalTxVersion}, value: binary.LittleEndian.AppendUint32(nil, uint32(tx.Version))},
+		{key: []byte{psbtGlobalInputCount}, value: compactSize(uint64(len(tx.TxIn)))},
+		{key: []byte{psbtGlobalOutputCount}, value: compactSize(uint64(len(tx.TxOut)))},
+		{key: []byte{psbtGlobalTxModifiable}, value: []byte{byte(p.Modifiable())}},
+		{key: []byte{psbtGlobalVersion}, value: binary.LittleEndian.AppendUint32(nil, 2)},
+	}
+	if p.FallbackLockTime != nil {
+		globals = append(globals, psbtKeyValue{key: []byte{psbtGlobalFallbackLockTime}, value: binary.LittleEndian.AppendUint32(nil, *p.FallbackLockTime)})
+	}
+	for _, kv := range v0Globals {
+		switch kv.key[0] {
+		case psbtGlobalUnsignedTx, psbtGlobalTxVersion, psbtGlobalFallbackLockTime, psbtGlobalInputCount,
+			psbtGlobalOutputCount, psbtGlobalTxModifiable, psbtGlobalVersion:
+		default:
+			globals = append(globals, kv)
+		}
+	}
+
+	inputLockTimes := p.inputLockTimes()
+	inputs := make([][]psbtKeyValue, len(tx.TxIn))
+	for i, txIn := range tx.TxIn {
+		kvs, err := readPSBTMap(&v0)
+		if err != nil {
+			return errors.Wrapf(err, "txin %d", i)
+		}
+
+		inputs[i] = []psbtKeyValue{
+			{key: []byte{psbtInPreviousTxID}, value: txIn.PreviousOutPoint.Hash[:]},
+			{key: []byte{psbtInOutputIndex}, value: binary.LittleEndian.AppendUint32(nil, txIn.PreviousOutPoint.Index)},
+		}
+		if txIn.Sequence != wire.MaxTxInSequenceNum {
+			inputs[i] = append(inputs[i], psbtKeyValue{key: []byte{psbtInSequence}, value: binary.LittleEndian.AppendUint32(nil, txIn.Sequence)})
+		}
+		if lockTime := inputLockTimes[i]; lockTime.Time != 0 {
+			inputs[i] = append(inputs[i], psbtKeyValue{key: []byte{psbtInRequiredTimeLockTime}, value: binary.LittleEndian.AppendUint32(nil, lockTime.Time)})
+		}
+		if lockTime := inputLockTimes[i]; lockTime.Height != 0 {
+			inputs[i] = append(inputs[i], psbtKeyValue{key: []byte{psbtInRequiredHeightLockTime}, value: binary.LittleEndian.AppendUint32(nil, lockTime.Height)})
+		}
+		for _, kv := range kvs {
+			switch kv.key[0] {
+			case psbtInPreviousTxID, psbtInOutputIndex, psbtInSequence, psbtInRequiredTimeLockTime, psbtInRequiredHeightLockTime:
+			default:
+				inputs[i] = append(inputs[i], kv)
+			}
+		}
+	}
+
+	outputs := make([][]psbtKeyValue, len(tx.TxOut))
+	for i, txOut := range tx.TxOut {
+		kvs, err := readPSBTMap(&v0)
+		if err != nil {
+			return errors.Wrapf(err, "txout %d", i)
+		}
+
+		outputs[i] = []psbtKeyValue{
+			{key: []byte{psbtOutAmount}, value: binary.LittleEndian.AppendUint64(nil, uint64(txOut.Value))},
+			{key: []byte{psbtOutScript}, value: txOut.PkScript},
+		}
+		for _, kv := range kvs {
+			switch kv.key[0] {
+			case psbtOutAmount, psbtOutScript:
+			default:
+				outputs[i] = append(outputs[i], kv)
+			}
+		}
+	}
+
+	return writePSBTMaps(w, globals, inputs, outputs)
+}
+
+// B64Encode is base64 encoding of Serialize
+func (p *PSBTv2) B64Encode() (string, error) {
+	var buf bytes.Buffer
+	if err := p.Serialize(&buf); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// inputLockTimes are InputLockTimes of every input
+func (p *PSBTv2) inputLockTimes() []PSBTInputLockTime {
+	inputLockTimes := make([]PSBTInputLockTime, len(p.Packet.Inputs))
+	copy(inputLockTimes, p.InputLockTimes)
+	return inputLockTimes
+}
+
+// lockTime of tx by BIP370: the greatest one of the type all inputs requiring lock time have, height if both fit
+func (p *PSBTv2) lockTime(inputLockTimes []PSBTInputLockTime) (uint32, error) {
+	var maxTime, maxHeight uint32
+	var required, timeOnly, heightOnly bool
+	for _, lockTime := range inputLockTimes {
+		if lockTime.Time == 0 && lockTime.Height == 0 {
+			continue
+		}
+		required = true
+		timeOnly = timeOnly || lockTime.Height == 0
+		heightOnly = heightOnly || lockTime.Time == 0
+		if lockTime.Time > maxTime {
+			maxTime = lockTime.Time
+		}
+		if lockTime.Height > maxHeight {
+			maxHeight = lockTime.Height
+		}
+	}
+
+	switch {
+	case !required && p.FallbackLockTime != nil:
+		return *p.FallbackLockTime, nil
+	case !required:
+		return 0, nil
+	case timeOnly && heightOnly:
+		return 0, errors.Wrap(ErrInvalidTxIn, "inputs require both time and height lock times")
+	case timeOnly:
+		return maxTime, nil
+	default:
+		return maxHeight, nil
+	}
+}
+
+func (l PSBTInputLockTime) validate() error {
+	if l.Time != 0 && l.Time < lockTimeThreshold {
+		return errors.Wrapf(ErrInvalidTxIn, "time lock time %d is below %d", l.Time, lockTimeThreshold)
+	}
+	if l.Height >= lockTimeThreshold {
+		return errors.Wrapf(ErrInvalidTxIn, "height lock time %d isn't below %d", l.Height, lockTimeThreshold)
+	}
+
+	return nil
+}
+
+// psbtInputSigHashTypes are sighash types of pInput signatures
+func psbtInputSigHashTypes(pInput *psbt.PInput) []txscript.SigHashType {
+	var sigHashTypes []txscript.SigHashType
+	for _, partialSig := range pInput.PartialSigs {
+		if len(partialSig.Signature) > 0 {
+			sigHashTypes = append(sigHashTypes, txscript.SigHashType(partialSig.Signature[len(partialSig.Signature)-1]))
+		}
+	}
+	switch len(pInput.TaprootKeySpendSig) {
+	case 0:
+	case 64:
+		sigHashTypes = append(sigHashTypes, txscript.SigHashDefault)
+	default:
+		sigHashTypes = append(sigHashTypes, txscript.SigHashType(pInput.TaprootKeySpendSig[len(pInput.TaprootKeySpendSig)-1]))
+	}
+	for _, sig := range pInput.TaprootScriptSpendSig {
+		sigHashTypes = append(sigHashTypes, sig.SigHash)
+	}
+
+	return sigHashTypes
+}
+
+// readPSBTMap reads key-value pairs up to the separator
+func readPSBTMap(r io.Reader) ([]psbtKeyValue, error) {
+	var kvs []psbtKeyValue
+	for {
+		key, err := wire.ReadVarBytes(r, 0, psbt.MaxPsbtKeyLength, "PSBT key")
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return kvs, nil
+		}
+
+		value, err := wire.ReadVarBytes(r, 0, psbt.MaxPsbtValueLength, "PSBT value")
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			if bytes.Equal(kv.key, key) {
+				return nil, errors.Errorf("duplicate key %x", key)
+			}
+		}
+
+		kvs = append(kvs, psbtKeyValue{key: key, value: value})
+	}
+}
+
+// writePSBTMaps writes magic and maps, their pairs sorted by key
+func writePSBTMaps(w io.Writer, globals []psbtKeyValue, inputs, outputs [][]psbtKeyValue) error {
+	if _, err := w.Write([]byte("psbt\xff")); err != nil {
+		return err
+	}
+
+	maps := append([][]psbtKeyValue{globals}, inputs...)
+	maps = append(maps, outputs...)
+	for _, kvs := range maps {
+		sort.SliceStable(kvs, func(i, j int) bool {
+			return bytes.Compare(kvs[i].key, kvs[j].key) < 0
+		})
+		for _, kv := range kvs {
+			if err := wire.WriteVarBytes(w, 0, kv.key); err != nil {
+				return err
+			}
+			if err := wire.WriteVarBytes(w, 0, kv.value); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write([]byte{0x00}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func compactSize(n uint64) []byte {
+	var buf bytes.Buffer
+	_ = wire.WriteVarInt(&buf, 0, n)
+	return buf.Bytes()
+}
+
+func readCompactSize(b []byte) (*uint64, error) {
+	r := bytes.NewReader(b)
+	n, err := wire.ReadVarInt(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("trailing bytes after compact size")
+	}
+
+	return &n, nil
+}
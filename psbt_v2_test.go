@@ -0,0 +1,208 @@
+package tx_forge
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/psbt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestPSBTv2(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+	}
+	prevTxId2 := "f34f6b2f2ef1bf6e8a9ab22a6bd8a42e0b1c47cb8d5dc1a2d1e5b4ddf4b0ac14"
+
+	wifPrivateKey1, wifPrivateKey2, _ := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	outputKey := txscript.ComputeTaprootOutputKey(wifPrivateKey2.PrivKey.PubKey(), nil)
+	pkScriptP2TR := payToAddr(btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), testParams.Network))
+
+	// sender's part of payjoin
+	forgeSenderPSBT := func(t *testing.T) *psbt.Packet {
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, nil)}
+		txIns[0].Bip32Derivation = []*psbt.Bip32Derivation{{PubKey: pubKey1, MasterKeyFingerprint: 1, Bip32Path: []uint32{0}}}
+		packet, _, err := ForgePSBT(txIns, []ForgeTxOut{{Value: 50000, Address: p2sh1}}, testParams)
+		require.NoError(t, err)
+		return packet
+	}
+
+	serialize := func(t *testing.T, p *PSBTv2) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, p.Serialize(&buf))
+		return buf.Bytes()
+	}
+
+	t.Run("round trip with v0", func(t *testing.T) {
+		packet := forgeSenderPSBT(t)
+		packet.Unknowns = []*psbt.Unknown{{Key: []byte{0xfc, 1}, Value: []byte{2}}}
+		packet.UnsignedTx.TxIn[0].Sequence = wire.MaxTxInSequenceNum - 2
+		packet.UnsignedTx.LockTime = 700000
+		var v0 bytes.Buffer
+		require.NoError(t, packet.Serialize(&v0))
+
+		p := NewPSBTv2(packet, PSBTInputsModifiable|PSBTOutputsModifiable)
+		require.NotNil(t, p.FallbackLockTime)
+		b64, err := p.B64Encode()
+		require.NoError(t, err)
+
+		parsed, err := ParsePSBTv2(strings.NewReader(b64), true)
+		require.NoError(t, err)
+		assert.Equal(t, p.Modifiable(), parsed.Modifiable())
+		assert.Equal(t, uint32(700000), *parsed.FallbackLockTime)
+		assert.Equal(t, serialize(t, p), serialize(t, parsed))
+
+		var parsedV0 bytes.Buffer
+		require.NoError(t, parsed.Packet.Serialize(&parsedV0))
+		assert.Equal(t, v0.Bytes(), parsedV0.Bytes())
+
+		// v0 packet isn't v2 one
+		_, err = ParsePSBTv2(bytes.NewReader(v0.Bytes()), false)
+		require.Error(t, err)
+		_, err = psbt.NewFromRawBytes(bytes.NewReader(serialize(t, p)), false)
+		require.Error(t, err)
+
+		// tx version is required by BIP370, it's the first global after magic
+		raw := serialize(t, p)
+		require.Equal(t, []byte{1, psbtGlobalTxVersion, 4}, raw[5:8])
+		_, err = ParsePSBTv2(bytes.NewReader(append(raw[:5:5], raw[12:]...)), false)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "tx version is missing")
+	})
+
+	t.Run("payjoin", func(t *testing.T) {
+		p := NewPSBTv2(forgeSenderPSBT(t), PSBTInputsModifiable|PSBTOutputsModifiable)
+		senderFee, err := p.Packet.GetTxFee()
+		require.NoError(t, err)
+
+		// receiver adds its input and output of the same value, handing packet back serialized
+		parsed, err := ParsePSBTv2(bytes.NewReader(serialize(t, p)), false)
+		require.NoError(t, err)
+		receiverTxIn := generateTxIn(prevTxId2, 1, 70000, pkScriptP2TR, nil)
+		require.NoError(t, parsed.AddInput(receiverTxIn, PSBTInputLockTime{}, testParams.Network))
+		require.NoError(t, parsed.AddOutput(ForgeTxOut{Value: 70000, Address: p2sh1}, testParams.Network))
+		require.ErrorIs(t, parsed.AddInput(receiverTxIn, PSBTInputLockTime{}, testParams.Network), ErrInvalidTxIn)
+
+		_, err = SignPSBT(parsed.Packet, WIFSigners(wifPrivateKey2))
+		require.NoError(t, err)
+		assert.Equal(t, PSBTModifiable(0), parsed.Modifiable())
+		require.ErrorIs(t, parsed.AddInput(generateTxIn(prevTxId2, 2, 1000, pkScriptP2TR, nil), PSBTInputLockTime{}, testParams.Network), ErrInvalidParams)
+		require.ErrorIs(t, parsed.AddOutput(ForgeTxOut{Value: 1000, Address: p2sh1}, testParams.Network), ErrInvalidParams)
+
+		// sender signs its input of the same packet
+		p, err = ParsePSBTv2(bytes.NewReader(serialize(t, parsed)), false)
+		require.NoError(t, err)
+		assert.Equal(t, PSBTModifiable(0), p.TxModifiable)
+		require.Len(t, p.Packet.Inputs, 2)
+		fee, err := p.Packet.GetTxFee()
+		require.NoError(t, err)
+		assert.Equal(t, senderFee, fee)
+
+		_, err = SignPSBT(p.Packet, WIFSigners(wifPrivateKey1))
+		require.NoError(t, err)
+		require.NoError(t, FinalizePSBT(p.Packet))
+		tx, err := ExtractPSBT(p.Packet)
+		require.NoError(t, err)
+		assert.Len(t, tx.TxIn, 2)
+		assert.Len(t, tx.TxOut, 3)
+	})
+
+	t.Run("modifiable", func(t *testing.T) {
+		testcases := []struct {
+			name           string
+			modifiable     PSBTModifiable
+			sigHashType    txscript.SigHashType
+			wantModifiable PSBTModifiable
+		}{
+			{
+				name:           "not modifiable",
+				modifiable:     0,
+				wantModifiable: 0,
+			},
+			{
+				name:           "outputs only",
+				modifiable:     PSBTOutputsModifiable,
+				wantModifiable: PSBTOutputsModifiable,
+			},
+			{
+				name:           "ALL",
+				modifiable:     PSBTInputsModifiable | PSBTOutputsModifiable,
+				sigHashType:    txscript.SigHashAll,
+				wantModifiable: 0,
+			},
+			{
+				name:           "ALL|ANYONECANPAY",
+				modifiable:     PSBTInputsModifiable | PSBTOutputsModifiable,
+				sigHashType:    txscript.SigHashAll | txscript.SigHashAnyOneCanPay,
+				wantModifiable: PSBTInputsModifiable,
+			},
+			{
+				name:           "NONE",
+				modifiable:     PSBTInputsModifiable | PSBTOutputsModifiable,
+				sigHashType:    txscript.SigHashNone,
+				wantModifiable: PSBTOutputsModifiable,
+			},
+			{
+				name:           "SINGLE|ANYONECANPAY",
+				modifiable:     PSBTInputsModifiable | PSBTOutputsModifiable,
+				sigHashType:    txscript.SigHashSingle | txscript.SigHashAnyOneCanPay,
+				wantModifiable: PSBTInputsModifiable | PSBTOutputsModifiable | PSBTHasSigHashSingle,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				p := NewPSBTv2(forgeSenderPSBT(t), tc.modifiable)
+				if tc.sigHashType != 0 {
+					p.Packet.Inputs[0].PartialSigs = []*psbt.PartialSig{{PubKey: pubKey1, Signature: []byte{0x30, byte(tc.sigHashType)}}}
+				}
+				assert.Equal(t, tc.wantModifiable, p.Modifiable())
+
+				txIn := generateTxIn(prevTxId2, 0, 1000, pkScriptP2TR, nil)
+				err := p.AddInput(txIn, PSBTInputLockTime{}, testParams.Network)
+				assert.Equal(t, tc.wantModifiable&PSBTInputsModifiable != 0, err == nil)
+				err = p.AddOutput(ForgeTxOut{Value: 1000, Address: p2sh1}, testParams.Network)
+				assert.Equal(t, tc.wantModifiable&PSBTOutputsModifiable != 0, err == nil)
+			})
+		}
+	})
+
+	t.Run("lock time", func(t *testing.T) {
+		p := NewPSBTv2(forgeSenderPSBT(t), PSBTInputsModifiable)
+		fallbackLockTime := uint32(100)
+		p.FallbackLockTime = &fallbackLockTime
+		require.NoError(t, p.AddInput(generateTxIn(prevTxId2, 0, 1000, pkScriptP2TR, nil), PSBTInputLockTime{}, testParams.Network))
+		assert.Equal(t, uint32(100), p.Packet.UnsignedTx.LockTime)
+
+		require.NoError(t, p.AddInput(generateTxIn(prevTxId2, 1, 1000, pkScriptP2TR, nil), PSBTInputLockTime{Height: 800000, Time: 1700000000}, testParams.Network))
+		assert.Equal(t, uint32(800000), p.Packet.UnsignedTx.LockTime)
+
+		require.NoError(t, p.AddInput(generateTxIn(prevTxId2, 2, 1000, pkScriptP2TR, nil), PSBTInputLockTime{Time: 1800000000}, testParams.Network))
+		assert.Equal(t, uint32(1800000000), p.Packet.UnsignedTx.LockTime)
+
+		// time is required already, so height only input can't be spent
+		err := p.AddInput(generateTxIn(prevTxId2, 3, 1000, pkScriptP2TR, nil), PSBTInputLockTime{Height: 800001}, testParams.Network)
+		require.ErrorIs(t, err, ErrInvalidTxIn)
+		assert.Len(t, p.Packet.Inputs, 4)
+
+		err = p.AddInput(generateTxIn(prevTxId2, 4, 1000, pkScriptP2TR, nil), PSBTInputLockTime{Time: 100}, testParams.Network)
+		require.ErrorIs(t, err, ErrInvalidTxIn)
+
+		parsed, err := ParsePSBTv2(bytes.NewReader(serialize(t, p)), false)
+		require.NoError(t, err)
+		assert.Equal(t, p.InputLockTimes, parsed.InputLockTimes)
+		assert.Equal(t, uint32(1800000000), parsed.Packet.UnsignedTx.LockTime)
+	})
+}
@@ -0,0 +1,145 @@
+package tx_forge
+
+import (
+	"bytes"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"sort"
+)
+
+const (
+	// rbfSequence is the highest sequence signaling BIP125 replaceability, the one Bitcoin Core sets
+	rbfSequence = wire.MaxTxInSequenceNum - 2
+	// incrementalRelayFeeRate is sat/vbyte replacement pays for its own relay on top of the original fee,
+	// default one of Bitcoin Core
+	incrementalRelayFeeRate = 1
+)
+
+// BumpFee is BIP125 replacement of original tx paying params.FeeRate, or more if it's needed to pay the original fee
+// plus incremental relay fee of the replacement, at fee rate higher than the original one.
+// txins are ForgeTxIns of original txins in any order, they are signed again. Txouts are kept but change of
+// params.ChangeAddress or ChangeLocker, which is required. Change is the only txout paying to it, if there is one,
+// several of them are ErrInvalidParams, as it's ambiguous which one is change and which are recipients. The fee is
+// always on top of txouts, whatever params.FeeStrategy is, so it's change which is reduced. If txins don't cover
+// the fee, confirmed coins of pool are added, the largest first, as BIP125 doesn't let replacement spend new
+// unconfirmed ones, and the rest of them goes to change. Replacement signals RBF as well, so it may be bumped again
+func BumpFee(original *wire.MsgTx, txins []ForgeTxIn, pool []ForgeTxIn, params *Params) (*wire.MsgTx, *ForgeSummary, error) {
+	if !isReplaceable(original) {
+		return nil, nil, errors.WithStack(ErrNotReplaceable)
+	}
+	if params.Network == nil {
+		return nil, nil, errors.Wrap(ErrInvalidParams, "Network can't be nil")
+	}
+	// recipients don't pay for the bump, and added coins aren't burned as the fee
+	if !params.hasChange() {
+		return nil, nil, errors.Wrap(ErrInvalidParams, "ChangeAddress or ChangeLocker is needed to take the fee from")
+	}
+
+	txinsByOutPoint := make(map[wire.OutPoint]*ForgeTxIn, len(txins))
+	for i := range txins {
+		outPoint, err := txins[i].outPoint()
+		if err != nil {
+			return nil, nil, err
+		}
+		txinsByOutPoint[*outPoint] = &txins[i]
+	}
+
+	// txins of original order
+	bumpTxIns := make([]ForgeTxIn, 0, len(original.TxIn))
+	var originalFee int
+	for i, txIn := range original.TxIn {
+		txin, ok := txinsByOutPoint[txIn.PreviousOutPoint]
+		if !ok {
+			return nil, nil, errors.Wrapf(ErrInvalidTxIn, "txin %d: there is no utxo %s in txins", i, txIn.PreviousOutPoint)
+		}
+		bumpTxIns = append(bumpTxIns, *txin)
+		originalFee += txin.Utxo.Value
+	}
+
+	changePkScript, err := (&ForgeTxOut{Address: params.ChangeAddress, Locker: params.ChangeLocker}).locker().LockingScript(params.Network)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "change")
+	}
+
+	changeIndex := -1
+	for i, txOut := range original.TxOut {
+		if !bytes.Equal(txOut.PkScript, changePkScript) {
+			continue
+		}
+		if changeIndex >= 0 {
+			return nil, nil, errors.Wrapf(ErrInvalidParams, "txouts %d and %d pay to change, either may be change", changeIndex, i)
+		}
+		changeIndex = i
+	}
+
+	// change is added again by ForgeTx
+	txouts := make([]ForgeTxOut, 0, len(original.TxOut))
+	for i, txOut := range original.TxOut {
+		originalFee -= int(txOut.Value)
+		if i == changeIndex {
+			continue
+		}
+		txouts = append(txouts, ForgeTxOut{Value: int(txOut.Value), Locker: &ScriptLocker{PkScript: txOut.PkScript}})
+	}
+	if originalFee < 0 {
+		return nil, nil, errors.Wrapf(ErrInvalidTxIn, "txins are worth %d less than original txouts", -originalFee)
+	}
+
+	// confirmed coins which aren't spent by original tx already
+	var extraTxIns []ForgeTxIn
+	for i := range pool {
+		outPoint, err := pool[i].outPoint()
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := txinsByOutPoint[*outPoint]; !ok && pool[i].Utxo.Height > 0 {
+			extraTxIns = append(extraTxIns, pool[i])
+		}
+	}
+	sort.SliceStable(extraTxIns, func(i, j int) bool {
+		return extraTxIns[i].Utxo.Value > extraTxIns[j].Utxo.Value
+	})
+
+	bumpParams := *params
+	bumpParams.RBF = true
+	bumpParams.FeeStrategy = FeeOnTop
+	// BIP125 rule 6: fee rate is higher than the original one
+	if minFeeRate := originalFee/vSize(original) + 1; bumpParams.FeeRate < minFeeRate {
+		bumpParams.FeeRate = minFeeRate
+	}
+
+	added := 0
+	for {
+		redeemTx, summary, err := ForgeTx(append(bumpTxIns[:len(bumpTxIns):len(bumpTxIns)], extraTxIns[:added]...), txouts, &bumpParams)
+		if errors.Is(err, &ErrInsufficientFunds{}) && added < len(extraTxIns) {
+			added++
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// BIP125 rules 3 and 4: fee is higher than the original one by incremental relay fee of replacement vsize
+		minFee := originalFee + incrementalRelayFeeRate*summary.VSize
+		if summary.Fee >= minFee {
+			return redeemTx, summary, nil
+		}
+
+		feeRate := (minFee + summary.VSize - 1) / summary.VSize
+		if feeRate <= bumpParams.FeeRate {
+			feeRate = bumpParams.FeeRate + 1
+		}
+		bumpParams.FeeRate = feeRate
+	}
+}
+
+// isReplaceable says whether tx signals BIP125 replaceability by sequence of any txin
+func isReplaceable(tx *wire.MsgTx) bool {
+	for _, txIn := range tx.TxIn {
+		if txIn.Sequence <= rbfSequence {
+			return true
+		}
+	}
+
+	return false
+}
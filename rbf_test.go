@@ -0,0 +1,201 @@
+package tx_forge
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBumpFee(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+		NeedToSign:    true,
+		RBF:           true,
+	}
+	prevTxId2 := "f34f6b2f2ef1bf6e8a9ab22a6bd8a42e0b1c47cb8d5dc1a2d1e5b4ddf4b0ac14"
+
+	wifPrivateKey1, _, _ := generateTestKeys(t)
+
+	pkScriptP2WPKH := generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network)
+	changeAddr, err := btcutil.DecodeAddress(testParams.ChangeAddress, testParams.Network)
+	require.NoError(t, err)
+	changePkScript, err := txscript.PayToAddrScript(changeAddr)
+	require.NoError(t, err)
+
+	txOuts := []ForgeTxOut{{Value: 50000, Address: p2sh1}}
+
+	// checkReplacement checks BIP125 rules of replacement of original tx
+	checkReplacement := func(t *testing.T, original *wire.MsgTx, originalSummary *ForgeSummary, replacement *wire.MsgTx, summary *ForgeSummary) {
+		assert.True(t, isReplaceable(replacement))
+		assert.GreaterOrEqual(t, summary.Fee, originalSummary.Fee+incrementalRelayFeeRate*vSize(replacement))
+		assert.Greater(t, float64(summary.Fee)/float64(vSize(replacement)), float64(originalSummary.Fee)/float64(vSize(original)))
+		assert.Equal(t, original.TxOut[0], replacement.TxOut[0])
+		for i, txIn := range original.TxIn {
+			assert.Equal(t, txIn.PreviousOutPoint, replacement.TxIn[i].PreviousOutPoint)
+		}
+	}
+
+	t.Run("RBF", func(t *testing.T) {
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, wifPrivateKey1)}
+		redeemTx, _, err := ForgeTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(0xfffffffd), redeemTx.TxIn[0].Sequence)
+		assert.True(t, isReplaceable(redeemTx))
+
+		params := *testParams
+		params.RBF = false
+		redeemTx, _, err = ForgeTx(txIns, txOuts, &params)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(wire.MaxTxInSequenceNum), redeemTx.TxIn[0].Sequence)
+		assert.False(t, isReplaceable(redeemTx))
+	})
+
+	t.Run("change is reduced", func(t *testing.T) {
+		txIns := []ForgeTxIn{
+			generateTxIn(prevTxId1, 0, 60000, pkScriptP2WPKH, wifPrivateKey1),
+			generateTxIn(prevTxId1, 1, 40000, pkScriptP2WPKH, wifPrivateKey1),
+		}
+		original, originalSummary, err := ForgeTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+
+		testcases := []struct {
+			name        string
+			feeRate     int
+			wantFeeRate int
+		}{
+			{
+				name:        "fee rate of params",
+				feeRate:     10,
+				wantFeeRate: 10,
+			},
+			{
+				name:    "fee rate below the original one",
+				feeRate: 1,
+				// the original fee and incremental relay fee
+				wantFeeRate: DefaultFeeRate + incrementalRelayFeeRate,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				params := *testParams
+				params.FeeRate = tc.feeRate
+				// txins of any order
+				replacement, summary, err := BumpFee(original, []ForgeTxIn{txIns[1], txIns[0]}, nil, &params)
+				require.NoError(t, err)
+				checkReplacement(t, original, originalSummary, replacement, summary)
+
+				require.Len(t, replacement.TxIn, 2)
+				require.Len(t, replacement.TxOut, 2)
+				assert.Equal(t, changePkScript, replacement.TxOut[1].PkScript)
+				assert.Equal(t, originalSummary.Change-(summary.Fee-originalSummary.Fee), summary.Change)
+				assert.Equal(t, tc.wantFeeRate*summary.VSize, summary.Fee)
+			})
+		}
+	})
+
+	t.Run("confirmed inputs are added", func(t *testing.T) {
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 50400, pkScriptP2WPKH, wifPrivateKey1)}
+		original, originalSummary, err := ForgeTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		require.Len(t, original.TxOut, 1)
+
+		pool := []ForgeTxIn{
+			txIns[0],
+			generateTxIn(prevTxId2, 0, 90000, pkScriptP2WPKH, wifPrivateKey1),
+			generateTxIn(prevTxId2, 1, 20000, pkScriptP2WPKH, wifPrivateKey1),
+			generateTxIn(prevTxId2, 2, 30000, pkScriptP2WPKH, wifPrivateKey1),
+		}
+		pool[2].Utxo.Height = 800000
+		pool[3].Utxo.Height = 800000
+
+		params := *testParams
+		params.FeeRate = 20
+		replacement, summary, err := BumpFee(original, txIns, pool, &params)
+		require.NoError(t, err)
+		checkReplacement(t, original, originalSummary, replacement, summary)
+
+		// the unconfirmed coin isn't spent, the largest confirmed one is
+		require.Len(t, replacement.TxIn, 2)
+		assert.Equal(t, uint32(2), replacement.TxIn[1].PreviousOutPoint.Index)
+		require.Len(t, replacement.TxOut, 2)
+		assert.Equal(t, 20*summary.VSize, summary.Fee)
+
+		// bumped again
+		params.FeeRate = 30
+		again, againSummary, err := BumpFee(replacement, []ForgeTxIn{pool[3], txIns[0]}, pool, &params)
+		require.NoError(t, err)
+		checkReplacement(t, replacement, summary, again, againSummary)
+
+		// there are no coins to pay for it
+		params.FeeRate = 500
+		_, _, err = BumpFee(original, txIns, pool[:3], &params)
+		require.ErrorIs(t, err, &ErrInsufficientFunds{})
+	})
+
+	t.Run("recipients don't pay", func(t *testing.T) {
+		pool := []ForgeTxIn{generateTxIn(prevTxId2, 0, 1000000, pkScriptP2WPKH, wifPrivateKey1)}
+		pool[0].Utxo.Height = 800000
+
+		// the original without change, its recipient paid the fee
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 50000, pkScriptP2WPKH, wifPrivateKey1)}
+		noChangeParams := *testParams
+		noChangeParams.ChangeAddress = ""
+		original, originalSummary, err := ForgeTx(txIns, txOuts, &noChangeParams)
+		require.NoError(t, err)
+		require.Len(t, original.TxOut, 1)
+		require.Less(t, original.TxOut[0].Value, int64(txOuts[0].Value))
+
+		for _, feeStrategy := range []FeeStrategy{FeeAuto, FeeOnTop, FeeFromOutput, FeeSplitProportional, FeeSplitEvenly} {
+			params := *testParams
+			params.FeeRate = 5
+			params.FeeStrategy = feeStrategy
+			replacement, summary, err := BumpFee(original, txIns, pool, &params)
+			require.NoError(t, err)
+			checkReplacement(t, original, originalSummary, replacement, summary)
+
+			// the added coin goes to change but the fee
+			require.Len(t, replacement.TxIn, 2)
+			require.Len(t, replacement.TxOut, 2)
+			assert.Equal(t, changePkScript, replacement.TxOut[1].PkScript)
+			assert.Equal(t, 5*summary.VSize, summary.Fee)
+			assert.Equal(t, 50000+1000000-int(original.TxOut[0].Value)-summary.Fee, summary.Change)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		txIns := []ForgeTxIn{generateTxIn(prevTxId1, 0, 100000, pkScriptP2WPKH, wifPrivateKey1)}
+		params := *testParams
+		params.RBF = false
+		original, _, err := ForgeTx(txIns, txOuts, &params)
+		require.NoError(t, err)
+		_, _, err = BumpFee(original, txIns, nil, testParams)
+		require.ErrorIs(t, err, ErrNotReplaceable)
+
+		original, _, err = ForgeTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		_, _, err = BumpFee(original, []ForgeTxIn{generateTxIn(prevTxId1, 1, 100000, pkScriptP2WPKH, wifPrivateKey1)}, nil, testParams)
+		require.ErrorIs(t, err, ErrInvalidTxIn)
+
+		// there is no change to take the fee from
+		for _, feeStrategy := range []FeeStrategy{FeeAuto, FeeOnTop} {
+			params := *testParams
+			params.ChangeAddress = ""
+			params.FeeStrategy = feeStrategy
+			_, _, err = BumpFee(original, txIns, nil, &params)
+			require.ErrorIs(t, err, ErrInvalidParams)
+		}
+
+		// recipient is paid to change address too, so it's ambiguous which txout is change
+		original, _, err = ForgeTx(txIns, append(txOuts, ForgeTxOut{Value: 20000, Address: p2sh2}), testParams)
+		require.NoError(t, err)
+		require.Len(t, original.TxOut, 3)
+		_, _, err = BumpFee(original, txIns, nil, testParams)
+		require.ErrorIs(t, err, ErrInvalidParams)
+	})
+}
@@ -0,0 +1,224 @@
+package tx_forge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/pkg/errors"
+)
+
+// Signer signs digests with a private key it holds, the key may be in memory, KMS, HSM or remote signing service.
+// Unlockers compute sighash digests of tx inputs and add sighash type to the signatures
+type Signer interface {
+	// PubKey is serialized public key of the signer, compressed or uncompressed one
+	PubKey() ([]byte, error)
+	// SignECDSA is DER encoded ECDSA signature of digest with low S
+	SignECDSA(digest []byte) ([]byte, error)
+	// SignSchnorr is BIP340 signature of digest. Taproot key-path is signed with the key tweaked by BIP341 tweak
+	// of merkleRoot, empty one for key-only outputs, while script-path is signed with the key itself
+	SignSchnorr(digest []byte, keyPath bool, merkleRoot []byte) ([]byte, error)
+}
+
+// WIFSigner is in-memory Signer of WIF private key
+type WIFSigner struct {
+	WIF *btcutil.WIF
+	// LowR grinds ECDSA signatures to R below 2^255, as Bitcoin Core does, so they are 71 bytes at most with sighash type
+	LowR bool
+}
+
+func (s *WIFSigner) PubKey() ([]byte, error) {
+	return s.WIF.SerializePubKey(), nil
+}
+
+func (s *WIFSigner) SignECDSA(digest []byte) ([]byte, error) {
+	if s.LowR {
+		return signLowR(s.WIF.PrivKey, digest), nil
+	}
+
+	return ecdsa.Sign(s.WIF.PrivKey, digest).Serialize(), nil
+}
+
+func (s *WIFSigner) SignSchnorr(digest []byte, keyPath bool, merkleRoot []byte) ([]byte, error) {
+	privKey := s.WIF.PrivKey
+	if keyPath {
+		privKey = txscript.TweakTaprootPrivKey(*privKey, merkleRoot)
+	}
+
+	signature, err := schnorr.Sign(privKey, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return signature.Serialize(), nil
+}
+
+// WIFSigners are in-memory signers of keys
+func WIFSigners(keys ...*btcutil.WIF) []Signer {
+	signers := make([]Signer, 0, len(keys))
+	for _, key := range keys {
+		signers = append(signers, &WIFSigner{WIF: key})
+	}
+
+	return signers
+}
+
+// signLowR is DER encoded ECDSA signature of digest with low R. RFC6979 nonce of the first attempt has no extra data,
+// so it's ecdsa.Sign signature if its R is low, the next ones have the attempt counter as little-endian extra data
+func signLowR(privKey *btcec.PrivateKey, digest []byte) []byte {
+	signature := ecdsa.Sign(privKey, digest).Serialize()
+
+	var extra [32]byte
+	for counter := uint32(1); !hasLowR(signature); counter++ {
+		binary.LittleEndian.PutUint32(extra[:], counter)
+		signature = signRFC6979(privKey, digest, extra[:]).Serialize()
+	}
+
+	return signature
+}
+
+// hasLowR says whether R of DER signature is 32 bytes at most, i.e. it needs no padding of the sign bit
+func hasLowR(signature []byte) bool {
+	// 0x30 <length> 0x02 <R length> <R> ...
+	return signature[3] <= 32
+}
+
+// signRFC6979 is ECDSA signature of digest with low S and RFC6979 nonce of extra data, see ecdsa.Sign
+func signRFC6979(privKey *btcec.PrivateKey, digest []byte, extra []byte) *ecdsa.Signature {
+	var privKeyBytes [32]byte
+	privKey.Key.PutBytes(&privKeyBytes)
+	defer func() { privKeyBytes = [32]byte{} }()
+
+	var e btcec.ModNScalar
+	e.SetByteSlice(digest)
+
+	for iteration := uint32(0); ; iteration++ {
+		k := btcec.NonceRFC6979(privKeyBytes[:], digest, extra, nil, iteration)
+
+		// r = kG.x mod N
+		var kG btcec.JacobianPoint
+		btcec.ScalarBaseMultNonConst(k, &kG)
+		kG.ToAffine()
+		var r btcec.ModNScalar
+		r.SetBytes(kG.X.Bytes())
+		if r.IsZero() {
+			k.Zero()
+			continue
+		}
+
+		// s = k^-1(e + dr) mod N, negated if it's over N/2
+		kInv := new(btcec.ModNScalar).InverseValNonConst(k)
+		k.Zero()
+		s := new(btcec.ModNScalar).Mul2(&privKey.Key, &r).Add(&e).Mul(kInv)
+		if s.IsZero() {
+			continue
+		}
+		if s.IsOverHalfOrder() {
+			s.Negate()
+		}
+
+		return ecdsa.NewSignature(&r, s)
+	}
+}
+
+// signerPubKey is parsed public key of signer
+func signerPubKey(signer Signer) (*btcec.PublicKey, error) {
+	pubKey, err := signer.PubKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "signer pubkey")
+	}
+
+	return btcec.ParsePubKey(pubKey)
+}
+
+// findSigner is the signer of pubKey, nil if there's none
+func findSigner(signers []Signer, pubKey []byte) (Signer, error) {
+	for _, signer := range signers {
+		signerPubKey, err := signer.PubKey()
+		if err != nil {
+			return nil, errors.Wrap(err, "signer pubkey")
+		}
+		if bytes.Equal(signerPubKey, pubKey) {
+			return signer, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// signECDSA is signature of ctx input spending scriptCode, witness v0 one if isWitness is set
+func signECDSA(ctx *UnlockContext, signer Signer, scriptCode []byte, isWitness bool) ([]byte, error) {
+	sigHashType := ctx.SigHashType
+	if sigHashType == txscript.SigHashDefault {
+		sigHashType = txscript.SigHashAll
+	}
+
+	var digest []byte
+	var err error
+	if isWitness {
+		digest, err = txscript.CalcWitnessSigHash(scriptCode, ctx.SigHashes, sigHashType, ctx.Tx, ctx.Idx, int64(ctx.Utxo.Value))
+	} else {
+		digest, err = txscript.CalcSignatureHash(scriptCode, sigHashType, ctx.Tx, ctx.Idx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signer.SignECDSA(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(signature, byte(sigHashType)), nil
+}
+
+// signTaproot is signature of ctx input, via key-path if tapLeaf is nil, or via script-path of tapLeaf
+func signTaproot(ctx *UnlockContext, signer Signer, merkleRoot []byte, tapLeaf *txscript.TapLeaf) ([]byte, error) {
+	prevOutFetcher := txscript.NewCannedPrevOutputFetcher(ctx.Utxo.PubKeyScript, int64(ctx.Utxo.Value))
+
+	var digest []byte
+	var err error
+	if tapLeaf == nil {
+		digest, err = txscript.CalcTaprootSignatureHash(ctx.SigHashes, ctx.SigHashType, ctx.Tx, ctx.Idx, prevOutFetcher)
+	} else {
+		digest, err = txscript.CalcTapscriptSignaturehash(ctx.SigHashes, ctx.SigHashType, ctx.Tx, ctx.Idx, prevOutFetcher, *tapLeaf)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signer.SignSchnorr(digest, tapLeaf == nil, merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	// SIGHASH_DEFAULT isn't appended
+	if ctx.SigHashType != txscript.SigHashDefault {
+		signature = append(signature, byte(ctx.SigHashType))
+	}
+
+	return signature, nil
+}
+
+// validateSigHashType checks sigHashType is ALL, NONE or SINGLE, with ANYONECANPAY or without, or 0.
+// SIGHASH_SINGLE of input idx needs txout idx, otherwise legacy sighash is the infamous 1 anyone can sign
+func validateSigHashType(sigHashType txscript.SigHashType, idx, txOutsCount int) error {
+	switch sigHashType &^ txscript.SigHashAnyOneCanPay {
+	case txscript.SigHashAll, txscript.SigHashNone:
+	case txscript.SigHashSingle:
+		if idx >= txOutsCount {
+			return errors.Wrapf(ErrInvalidSigHashType, "SIGHASH_SINGLE has no txout %d to commit to", idx)
+		}
+	case txscript.SigHashDefault:
+		if sigHashType != txscript.SigHashDefault {
+			return errors.Wrapf(ErrInvalidSigHashType, "%#x", sigHashType)
+		}
+	default:
+		return errors.Wrapf(ErrInvalidSigHashType, "%#x", sigHashType)
+	}
+
+	return nil
+}
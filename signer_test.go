@@ -0,0 +1,491 @@
+package tx_forge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// remoteSigner is a stand-in of KMS or remote signing service: it knows the pubkey only,
+// digests are signed by sign callback and recorded
+type remoteSigner struct {
+	pubKey  []byte
+	sign    Signer
+	err     error
+	digests [][]byte
+}
+
+func (s *remoteSigner) PubKey() ([]byte, error) {
+	return s.pubKey, nil
+}
+
+func (s *remoteSigner) SignECDSA(digest []byte) ([]byte, error) {
+	s.digests = append(s.digests, digest)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.sign.SignECDSA(digest)
+}
+
+func (s *remoteSigner) SignSchnorr(digest []byte, keyPath bool, merkleRoot []byte) ([]byte, error) {
+	s.digests = append(s.digests, digest)
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.sign.SignSchnorr(digest, keyPath, merkleRoot)
+}
+
+func newRemoteSigner(wif *btcutil.WIF) *remoteSigner {
+	return &remoteSigner{pubKey: wif.SerializePubKey(), sign: &WIFSigner{WIF: wif}}
+}
+
+func TestSigner(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+		NeedToSign:    true,
+	}
+
+	wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 := generateTestKeys(t)
+	uncompressedKey, err := btcutil.NewWIF(wifPrivateKey3.PrivKey, testParams.Network, false)
+	require.NoError(t, err)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	witnessProgram, err := GetWitnessProgramFromPrivateKey(wifPrivateKey1, testParams.Network)
+	require.NoError(t, err)
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+	multiSigScriptHash := sha256.Sum256(multiSigScript)
+
+	tapTree := generateTapTree(t, wifPrivateKey1, wifPrivateKey2, testParams.Network)
+	pkScriptP2TR := tapTree.PkScript
+
+	txOuts := []ForgeTxOut{{Value: 10000, Address: p2sh1}}
+
+	testcases := []struct {
+		name     string
+		pkScript []byte
+		// txIn sets keys of WIFPrivKey or WIFPrivKeys, and Signer or Signers
+		txIn func(txIn *ForgeTxIn, keys bool)
+	}{
+		{
+			name:     "p2pkh",
+			pkScript: payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey1), testParams.Network)),
+		},
+		{
+			name:     "p2pkh of uncompressed pubkey",
+			pkScript: payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(uncompressedKey.SerializePubKey()), testParams.Network)),
+			txIn: func(txIn *ForgeTxIn, keys bool) {
+				if keys {
+					txIn.WIFPrivKey = uncompressedKey
+				} else {
+					txIn.Signer = newRemoteSigner(uncompressedKey)
+				}
+			},
+		},
+		{
+			name:     "p2pk",
+			pkScript: payToAddr(btcutil.NewAddressPubKey(pubKey1, testParams.Network)),
+		},
+		{
+			name:     "p2wpkh",
+			pkScript: generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network),
+		},
+		{
+			name:     "p2sh-p2wpkh",
+			pkScript: GetPkScriptFromWitnessProgram(witnessProgram),
+		},
+		{
+			name:     "p2tr key-path",
+			pkScript: pkScriptP2TR,
+			txIn: func(txIn *ForgeTxIn, keys bool) {
+				txIn.TaprootMerkleRoot = tapTree.MerkleRoot
+				if keys {
+					txIn.WIFPrivKey = wifPrivateKey1
+				} else {
+					txIn.Signer = newRemoteSigner(wifPrivateKey1)
+				}
+			},
+		},
+		{
+			name:     "p2tr script-path",
+			pkScript: pkScriptP2TR,
+			txIn: func(txIn *ForgeTxIn, keys bool) {
+				txIn.TapScript = &TapScriptSpend{LeafScript: tapTree.LeafScript, ControlBlock: tapTree.ControlBlock}
+				if keys {
+					txIn.WIFPrivKey = wifPrivateKey2
+				} else {
+					txIn.Signer = newRemoteSigner(wifPrivateKey2)
+				}
+			},
+		},
+		{
+			name:     "p2wsh multisig",
+			pkScript: payToAddr(btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network)),
+			txIn: func(txIn *ForgeTxIn, keys bool) {
+				txIn.WitnessScript = multiSigScript
+				if keys {
+					txIn.WIFPrivKeys = []*btcutil.WIF{wifPrivateKey3, wifPrivateKey2}
+				} else {
+					txIn.Signers = []Signer{newRemoteSigner(wifPrivateKey3), newRemoteSigner(wifPrivateKey2)}
+				}
+			},
+		},
+		{
+			name:     "p2sh multisig",
+			pkScript: payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network)),
+			txIn: func(txIn *ForgeTxIn, keys bool) {
+				txIn.RedeemScript = multiSigScript
+				if keys {
+					txIn.WIFPrivKeys = []*btcutil.WIF{wifPrivateKey1, wifPrivateKey3}
+				} else {
+					txIn.Signers = []Signer{newRemoteSigner(wifPrivateKey1), &WIFSigner{WIF: wifPrivateKey3}}
+				}
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			generate := func(keys bool) ForgeTxIn {
+				txIn := generateTxIn(prevTxId1, 0, 100000, tc.pkScript, nil)
+				switch {
+				case tc.txIn != nil:
+					tc.txIn(&txIn, keys)
+				case keys:
+					txIn.WIFPrivKey = wifPrivateKey1
+				default:
+					txIn.Signer = newRemoteSigner(wifPrivateKey1)
+				}
+				return txIn
+			}
+
+			// signer makes the same tx as in-memory key does
+			wantTx, wantSummary, err := ForgeTx([]ForgeTxIn{generate(true)}, txOuts, testParams)
+			require.NoError(t, err)
+
+			txIn := generate(false)
+			redeemTx, summary, err := ForgeTx([]ForgeTxIn{txIn}, txOuts, testParams)
+			require.NoError(t, err)
+			assert.Equal(t, wantSummary, summary)
+			assert.Equal(t, wantTx, redeemTx)
+
+			// PSBT is signed by the same signers
+			unsignedParams := *testParams
+			unsignedParams.NeedToSign = false
+			packet, _, err := ForgePSBT([]ForgeTxIn{generate(false)}, txOuts, &unsignedParams)
+			require.NoError(t, err)
+			signers := append([]Signer{txIn.Signer}, txIn.Signers...)
+			if txIn.Signer == nil {
+				signers = txIn.Signers
+			}
+			signed, err := SignPSBT(packet, signers)
+			require.NoError(t, err)
+			assert.Equal(t, []int{0}, signed)
+			require.NoError(t, FinalizePSBT(packet))
+			_, err = ExtractPSBT(packet)
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("private key stays with signer", func(t *testing.T) {
+		signer := newRemoteSigner(wifPrivateKey1)
+		txIn := generateTxIn(prevTxId1, 0, 100000, pkScriptP2TR, nil)
+		txIn.TaprootMerkleRoot = tapTree.MerkleRoot
+		txIn.Signer = signer
+
+		redeemTx, _, err := ForgeTx([]ForgeTxIn{txIn}, txOuts, testParams)
+		require.NoError(t, err)
+		require.NotEmpty(t, signer.digests)
+		require.Len(t, redeemTx.TxIn[0].Witness, 1)
+
+		// tx is signed again after the fee is known, the last digest is of the tx
+		signature, err := schnorr.ParseSignature(redeemTx.TxIn[0].Witness[0])
+		require.NoError(t, err)
+		assert.True(t, signature.Verify(signer.digests[len(signer.digests)-1], tapTree.OutputKey))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		signErr := errors.New("signing service is unavailable")
+		testcases := []struct {
+			name   string
+			signer Signer
+		}{
+			{
+				name:   "signing fails",
+				signer: &remoteSigner{pubKey: pubKey1, sign: &WIFSigner{WIF: wifPrivateKey1}, err: signErr},
+			},
+			{
+				name:   "signer of another key",
+				signer: &remoteSigner{pubKey: pubKey1, sign: &WIFSigner{WIF: wifPrivateKey2}},
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				txIn := generateTxIn(prevTxId1, 0, 100000, generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network), nil)
+				txIn.Signer = tc.signer
+
+				_, _, err := ForgeTx([]ForgeTxIn{txIn}, txOuts, testParams)
+				require.Error(t, err)
+			})
+		}
+
+		// multisig signers without enough keys of the script
+		txIn := generateTxIn(prevTxId1, 0, 100000, payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network)), nil)
+		txIn.RedeemScript = multiSigScript
+		txIn.Signers = []Signer{newRemoteSigner(wifPrivateKey1), newRemoteSigner(uncompressedKey)}
+		_, _, err := ForgeTx([]ForgeTxIn{txIn}, txOuts, testParams)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, errNotEnoughSignatures))
+
+		// inputs without Signer and WIFPrivKey
+		witnessProgram, err := GetWitnessProgramFromPrivateKey(wifPrivateKey1, testParams.Network)
+		require.NoError(t, err)
+		keylessTxIns := append(
+			generateMixedTxIns(t, prevTxId1, 3, wifPrivateKey1, testParams.Network),
+			generateTxIn(prevTxId1, 3, 10000, payToAddr(btcutil.NewAddressPubKey(pubKey1, testParams.Network)), nil),
+			generateTxIn(prevTxId1, 4, 10000, payToAddr(btcutil.NewAddressScriptHash(witnessProgram, testParams.Network)), nil),
+		)
+		for i := range keylessTxIns {
+			txIns := []ForgeTxIn{generateTxIn(prevTxId1, 10, 100000, generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network), wifPrivateKey1), keylessTxIns[i]}
+			txIns[1].WIFPrivKey = nil
+			_, _, err := ForgeTx(txIns, txOuts, testParams)
+			require.ErrorIs(t, err, &ErrInputSignature{Index: 1})
+			assert.ErrorIs(t, err, errNoSigner)
+		}
+	})
+
+	t.Run("low R", func(t *testing.T) {
+		// RFC6979 nonce without extra data is the one of ecdsa.Sign
+		digest := sha256.Sum256([]byte("low R"))
+		assert.Equal(t, ecdsa.Sign(wifPrivateKey1.PrivKey, digest[:]).Serialize(), signRFC6979(wifPrivateKey1.PrivKey, digest[:], nil).Serialize())
+
+		signer := &WIFSigner{WIF: wifPrivateKey1, LowR: true}
+		highR := 0
+		for i := 0; i < 64; i++ {
+			digest := sha256.Sum256([]byte{byte(i)})
+			if !hasLowR(ecdsa.Sign(wifPrivateKey1.PrivKey, digest[:]).Serialize()) {
+				highR++
+			}
+
+			signature, err := signer.SignECDSA(digest[:])
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(signature), lowRECDSASigSize-1)
+			assert.True(t, hasLowR(signature))
+			parsed, err := ecdsa.ParseDERSignature(signature)
+			require.NoError(t, err)
+			assert.True(t, parsed.Verify(digest[:], wifPrivateKey1.PrivKey.PubKey()))
+		}
+		assert.NotZero(t, highR)
+
+		// estimate of low R signatures is the size of signed tx, taproot ones are left out as their estimate
+		// is of signature with sighash type
+		lowRParams := *testParams
+		lowRParams.LowR = true
+		var txIns []ForgeTxIn
+		for _, txIn := range generateMixedTxIns(t, prevTxId1, 30, wifPrivateKey1, testParams.Network) {
+			if !txscript.IsPayToTaproot(txIn.Utxo.PubKeyScript) {
+				txIns = append(txIns, txIn)
+			}
+		}
+		multiSigTxIn := generateTxIn(prevTxId1, 30, 100000, payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network)), nil)
+		multiSigTxIn.RedeemScript = multiSigScript
+		multiSigTxIn.WIFPrivKeys = []*btcutil.WIF{wifPrivateKey1, wifPrivateKey2}
+		txIns = append(txIns, multiSigTxIn)
+
+		estimated, err := EstimateTx(txIns, txOuts, &lowRParams)
+		require.NoError(t, err)
+		_, summary, err := ForgeTx(txIns, txOuts, &lowRParams)
+		require.NoError(t, err)
+		assert.Equal(t, estimated.Fee, summary.Fee)
+		// 1 in 128 signatures has R or S shorter still, so the estimate is the upper bound of vsize
+		assert.LessOrEqual(t, estimated.VSize-summary.VSize, 1)
+		assert.GreaterOrEqual(t, estimated.VSize, summary.VSize)
+
+		estimated, err = EstimateTx(txIns, txOuts, testParams)
+		require.NoError(t, err)
+		assert.Greater(t, estimated.VSize, summary.VSize)
+	})
+
+	t.Run("WIFSigners", func(t *testing.T) {
+		signers := WIFSigners(wifPrivateKey1, wifPrivateKey2)
+		require.Len(t, signers, 2)
+		pubKey, err := signers[1].PubKey()
+		require.NoError(t, err)
+		assert.True(t, bytes.Equal(wifPrivateKey2.SerializePubKey(), pubKey))
+	})
+}
+
+func TestSigHashType(t *testing.T) {
+	testParams := &Params{
+		FeeRate:       DefaultFeeRate,
+		Network:       &chaincfg.TestNet3Params,
+		ChangeAddress: p2sh2,
+		NeedToSign:    true,
+	}
+	prevTxId2 := "f34f6b2f2ef1bf6e8a9ab22a6bd8a42e0b1c47cb8d5dc1a2d1e5b4ddf4b0ac14"
+
+	wifPrivateKey1, wifPrivateKey2, _ := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	pkScripts := map[string][]byte{
+		"p2pkh":  payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey1), testParams.Network)),
+		"p2wpkh": generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network),
+		"p2tr":   payToAddr(btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootOutputKey(wifPrivateKey1.PrivKey.PubKey(), nil)), testParams.Network)),
+	}
+	pkScriptP2WPKH2 := generateP2WPKHPkScript(t, wifPrivateKey2, testParams.Network)
+	txOuts := []ForgeTxOut{{Value: 10000, Address: p2sh1}}
+
+	sigHashTypes := []txscript.SigHashType{
+		txscript.SigHashDefault,
+		txscript.SigHashAll,
+		txscript.SigHashNone,
+		txscript.SigHashSingle,
+		txscript.SigHashAll | txscript.SigHashAnyOneCanPay,
+		txscript.SigHashNone | txscript.SigHashAnyOneCanPay,
+		txscript.SigHashSingle | txscript.SigHashAnyOneCanPay,
+	}
+	for name, pkScript := range pkScripts {
+		for _, sigHashType := range sigHashTypes {
+			t.Run(fmt.Sprintf("%s %#x", name, sigHashType), func(t *testing.T) {
+				txIn := generateTxIn(prevTxId1, 0, 100000, pkScript, wifPrivateKey1)
+				txIn.SigHashType = sigHashType
+
+				// ForgeTx verifies every signature by executing its script
+				redeemTx, summary, err := ForgeTx([]ForgeTxIn{txIn}, txOuts, testParams)
+				require.NoError(t, err)
+
+				var signature []byte
+				if name == "p2pkh" {
+					pushes, err := txscript.PushedData(redeemTx.TxIn[0].SignatureScript)
+					require.NoError(t, err)
+					signature = pushes[0]
+				} else {
+					signature = redeemTx.TxIn[0].Witness[0]
+				}
+				switch {
+				case name == "p2tr" && sigHashType == txscript.SigHashDefault:
+					assert.Len(t, signature, schnorr.SignatureSize)
+				case sigHashType == txscript.SigHashDefault:
+					assert.Equal(t, byte(txscript.SigHashAll), signature[len(signature)-1])
+				default:
+					assert.Equal(t, byte(sigHashType), signature[len(signature)-1])
+				}
+
+				hasWarning := false
+				for _, warning := range summary.Warnings {
+					hasWarning = hasWarning || strings.Contains(warning, "SIGHASH_NONE")
+				}
+				assert.Equal(t, sigHashType&^txscript.SigHashAnyOneCanPay == txscript.SigHashNone, hasWarning)
+			})
+		}
+	}
+
+	t.Run("ANYONECANPAY pledge stays valid with other inputs", func(t *testing.T) {
+		pledge := generateTxIn(prevTxId1, 0, 100000, pkScripts["p2wpkh"], wifPrivateKey1)
+		pledge.SigHashType = txscript.SigHashAll | txscript.SigHashAnyOneCanPay
+		txIns := []ForgeTxIn{pledge, generateTxIn(prevTxId2, 0, 100000, pkScriptP2WPKH2, wifPrivateKey2)}
+
+		redeemTx, _, err := ForgeTx(txIns, []ForgeTxOut{{Value: 150000, Address: p2sh1}}, testParams)
+		require.NoError(t, err)
+
+		// another backer replaces the second input
+		prevOuts := map[wire.OutPoint]*wire.TxOut{
+			redeemTx.TxIn[0].PreviousOutPoint: wire.NewTxOut(100000, pkScripts["p2wpkh"]),
+		}
+		otherOutPoint := wire.OutPoint{Hash: redeemTx.TxIn[1].PreviousOutPoint.Hash, Index: 1}
+		prevOuts[otherOutPoint] = wire.NewTxOut(200000, pkScriptP2WPKH2)
+		redeemTx.TxIn[1] = wire.NewTxIn(&otherOutPoint, nil, nil)
+
+		outputFetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+		sigHashes := txscript.NewTxSigHashes(redeemTx, outputFetcher)
+		require.NoError(t, verifyTxIn(redeemTx, 0, prevOuts[redeemTx.TxIn[0].PreviousOutPoint], sigHashes, outputFetcher))
+
+		// SIGHASH_ALL one doesn't
+		txIns[0].SigHashType = txscript.SigHashAll
+		redeemTx, _, err = ForgeTx(txIns, []ForgeTxOut{{Value: 150000, Address: p2sh1}}, testParams)
+		require.NoError(t, err)
+		redeemTx.TxIn[1] = wire.NewTxIn(&otherOutPoint, nil, nil)
+		sigHashes = txscript.NewTxSigHashes(redeemTx, outputFetcher)
+		require.Error(t, verifyTxIn(redeemTx, 0, prevOuts[redeemTx.TxIn[0].PreviousOutPoint], sigHashes, outputFetcher))
+	})
+
+	t.Run("PSBT", func(t *testing.T) {
+		txIn := generateTxIn(prevTxId1, 0, 100000, pkScripts["p2tr"], wifPrivateKey1)
+		txIn.SigHashType = txscript.SigHashSingle | txscript.SigHashAnyOneCanPay
+		unsignedParams := *testParams
+		unsignedParams.NeedToSign = false
+		packet, _, err := ForgePSBT([]ForgeTxIn{txIn}, txOuts, &unsignedParams)
+		require.NoError(t, err)
+		assert.Equal(t, txIn.SigHashType, packet.Inputs[0].SighashType)
+
+		_, err = SignPSBT(packet, WIFSigners(wifPrivateKey1))
+		require.NoError(t, err)
+		signature := packet.Inputs[0].TaprootKeySpendSig
+		assert.Equal(t, byte(txIn.SigHashType), signature[len(signature)-1])
+		require.NoError(t, FinalizePSBT(packet))
+		_, err = ExtractPSBT(packet)
+		require.NoError(t, err)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		testcases := []struct {
+			name        string
+			sigHashType txscript.SigHashType
+			// idx of the input of sigHashType
+			idx int
+		}{
+			{
+				name:        "SINGLE without txout",
+				sigHashType: txscript.SigHashSingle,
+				idx:         2,
+			},
+			{
+				name:        "SINGLE|ANYONECANPAY without txout",
+				sigHashType: txscript.SigHashSingle | txscript.SigHashAnyOneCanPay,
+				idx:         2,
+			},
+			{
+				name:        "ANYONECANPAY alone",
+				sigHashType: txscript.SigHashAnyOneCanPay,
+			},
+			{
+				name:        "unknown",
+				sigHashType: 4,
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				txIns := []ForgeTxIn{
+					generateTxIn(prevTxId1, 0, 100000, pkScripts["p2wpkh"], wifPrivateKey1),
+					generateTxIn(prevTxId1, 1, 100000, pkScripts["p2wpkh"], wifPrivateKey1),
+					generateTxIn(prevTxId1, 2, 100000, pkScripts["p2wpkh"], wifPrivateKey1),
+				}
+				txIns[tc.idx].SigHashType = tc.sigHashType
+
+				_, _, err := ForgeTx(txIns, txOuts, testParams)
+				require.Error(t, err)
+
+				unsignedParams := *testParams
+				unsignedParams.NeedToSign = false
+				_, _, err = ForgePSBT(txIns, txOuts, &unsignedParams)
+				require.Error(t, err)
+			})
+		}
+	})
+}
@@ -0,0 +1,526 @@
+package tx_forge
+
+import (
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/pkg/errors"
+)
+
+// Unlocker builds scriptSig and witness spending UTXO, it's the way to add your own script types
+type Unlocker interface {
+	// Unlock returns scriptSig and witness of ctx.Tx.TxIn[ctx.Idx], ctx.Tx must not be modified
+	Unlock(ctx *UnlockContext) (signatureScript []byte, witness wire.TxWitness, err error)
+	// Size is the worst case size of the input spent by Unlock
+	Size() ForgeTxInSize
+}
+
+// UnlockContext is what Unlocker gets to spend Utxo in Tx.TxIn[Idx]
+type UnlockContext struct {
+	Tx   *wire.MsgTx
+	Idx  int
+	Utxo UTXO
+	// SigHashes are built with all previous outputs of Tx
+	SigHashes *txscript.TxSigHashes
+	// SigHashType of signatures, 0 is SIGHASH_ALL of ECDSA and SIGHASH_DEFAULT of taproot
+	SigHashType txscript.SigHashType
+	Network     *chaincfg.Params
+}
+
+const (
+	// txInBaseSize is outpoint, sequence and at most 252 byte long scriptSig length
+	txInBaseSize = 32 + 4 + 4 + 1
+
+	// maxECDSASigSize is DER signature with low S and 33 byte R, plus sighash type
+	maxECDSASigSize = 72
+	// lowRECDSASigSize is maxECDSASigSize of signature with low R, see WIFSigner.LowR
+	lowRECDSASigSize = 71
+	// maxSchnorrSigSize is a signature with non-default sighash type
+	maxSchnorrSigSize = schnorr.SignatureSize + 1
+
+	compressedPubKeySize   = 33
+	uncompressedPubKeySize = 65
+)
+
+// errNoSigner means the input has neither Signer nor WIFPrivKey to sign it
+var errNoSigner = errors.New("there is no signer")
+
+// P2PKHUnlocker spends P2PKH output with <sig> <pubkey> scriptSig
+type P2PKHUnlocker struct {
+	Signer Signer
+}
+
+func (u *P2PKHUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	if u.Signer == nil {
+		return nil, nil, errors.WithStack(errNoSigner)
+	}
+	signature, err := signECDSA(ctx, u.Signer, ctx.Utxo.PubKeyScript, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubKey, err := u.Signer.PubKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signatureScript, err := txscript.NewScriptBuilder().AddData(signature).AddData(pubKey).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signatureScript, nil, nil
+}
+
+func (u *P2PKHUnlocker) Size() ForgeTxInSize {
+	pubKeySize := compressedPubKeySize
+	if u.Signer != nil {
+		if pubKey, err := u.Signer.PubKey(); err == nil && len(pubKey) == uncompressedPubKeySize {
+			pubKeySize = uncompressedPubKeySize
+		}
+	}
+
+	return ForgeTxInSize{
+		SerializedSize: txInBaseSize + pushDataSize(ecdsaSigSize(u.Signer)) + pushDataSize(pubKeySize),
+	}
+}
+
+// P2PKUnlocker spends P2PK output with bare <sig> scriptSig, pubkey is already in pkScript
+type P2PKUnlocker struct {
+	Signer Signer
+}
+
+func (u *P2PKUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	if u.Signer == nil {
+		return nil, nil, errors.WithStack(errNoSigner)
+	}
+	signature, err := signECDSA(ctx, u.Signer, ctx.Utxo.PubKeyScript, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signatureScript, err := txscript.NewScriptBuilder().AddData(signature).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signatureScript, nil, nil
+}
+
+func (u *P2PKUnlocker) Size() ForgeTxInSize {
+	return ForgeTxInSize{
+		SerializedSize: txInBaseSize + pushDataSize(ecdsaSigSize(u.Signer)),
+	}
+}
+
+// P2WPKHUnlocker spends native P2WPKH output with an empty scriptSig and <sig> <pubkey> witness
+type P2WPKHUnlocker struct {
+	Signer Signer
+}
+
+func (u *P2WPKHUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	if u.Signer == nil {
+		return nil, nil, errors.WithStack(errNoSigner)
+	}
+	// pkScript is the witness program itself
+	witness, err := p2wpkhWitness(ctx, u.Signer, ctx.Utxo.PubKeyScript)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, witness, nil
+}
+
+// p2wpkhWitness is <sig> <pubkey> of signer spending witnessProgram
+func p2wpkhWitness(ctx *UnlockContext, signer Signer, witnessProgram []byte) (wire.TxWitness, error) {
+	signature, err := signECDSA(ctx, signer, witnessProgram, true)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := signer.PubKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return wire.TxWitness{signature, pubKey}, nil
+}
+
+func (u *P2WPKHUnlocker) Size() ForgeTxInSize {
+	return ForgeTxInSize{
+		Witness:        p2wpkhWitnessSize(u.Signer),
+		SerializedSize: txInBaseSize,
+	}
+}
+
+// p2wpkhWitnessSize is items count, <sig> of signer and <compressed pubkey>
+func p2wpkhWitnessSize(signer Signer) int {
+	return 1 + 1 + ecdsaSigSize(signer) + 1 + compressedPubKeySize
+}
+
+// P2SHP2WPKHUnlocker spends P2SH-P2WPKH output, scriptSig is a single push of the witness program
+type P2SHP2WPKHUnlocker struct {
+	Signer Signer
+}
+
+func (u *P2SHP2WPKHUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	if u.Signer == nil {
+		return nil, nil, errors.WithStack(errNoSigner)
+	}
+	pubKey, err := u.Signer.PubKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(btcutil.Hash160(pubKey)).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	witness, err := p2wpkhWitness(ctx, u.Signer, witnessProgram)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signatureScript, err := txscript.NewScriptBuilder().AddData(witnessProgram).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signatureScript, witness, nil
+}
+
+func (u *P2SHP2WPKHUnlocker) Size() ForgeTxInSize {
+	return ForgeTxInSize{
+		Witness:        p2wpkhWitnessSize(u.Signer),
+		SerializedSize: txInBaseSize + pushDataSize(22),
+	}
+}
+
+// P2TRUnlocker spends P2TR output via key-path with a bare schnorr signature witness
+type P2TRUnlocker struct {
+	Signer Signer
+	// MerkleRoot is a root of the script tree committed to by output key, empty for key-only (BIP86) outputs
+	MerkleRoot []byte
+}
+
+func (u *P2TRUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	if u.Signer == nil {
+		return nil, nil, errors.WithStack(errNoSigner)
+	}
+	// BIP341 sighash signed by the key tweaked with MerkleRoot
+	signature, err := signTaproot(ctx, u.Signer, u.MerkleRoot, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return nil, wire.TxWitness{signature}, nil
+}
+
+func (u *P2TRUnlocker) Size() ForgeTxInSize {
+	return ForgeTxInSize{
+		Witness:        1 + 1 + maxSchnorrSigSize,
+		SerializedSize: txInBaseSize,
+	}
+}
+
+// P2TRScriptUnlocker spends P2TR output via script-path: <args...> <leaf script> <control block>
+type P2TRScriptUnlocker struct {
+	// Signer signs the leaf, may be nil if the leaf doesn't need a signature
+	Signer    Signer
+	TapScript *TapScriptSpend
+}
+
+func (u *P2TRScriptUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	tapScript := u.TapScript
+
+	controlBlock, err := txscript.ParseControlBlock(tapScript.ControlBlock)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "control block")
+	}
+
+	args := tapScript.Args
+	if u.Signer != nil {
+		if tapScript.SignatureIndex < 0 || tapScript.SignatureIndex > len(args) {
+			return nil, nil, errors.Errorf("signature index %d is out of args range", tapScript.SignatureIndex)
+		}
+
+		tapLeaf := txscript.NewTapLeaf(controlBlock.LeafVersion, tapScript.LeafScript)
+		signature, err := signTaproot(ctx, u.Signer, nil, &tapLeaf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		args = make([][]byte, 0, len(tapScript.Args)+1)
+		args = append(args, tapScript.Args[:tapScript.SignatureIndex]...)
+		args = append(args, signature)
+		args = append(args, tapScript.Args[tapScript.SignatureIndex:]...)
+	}
+
+	witness := make(wire.TxWitness, 0, len(args)+2)
+	witness = append(witness, args...)
+
+	return nil, append(witness, tapScript.LeafScript, tapScript.ControlBlock), nil
+}
+
+func (u *P2TRScriptUnlocker) Size() ForgeTxInSize {
+	itemsCount := len(u.TapScript.Args) + 2
+	witnessSize := 0
+	if u.Signer != nil {
+		itemsCount++
+		witnessSize += witnessItemSize(maxSchnorrSigSize)
+	}
+	for _, arg := range u.TapScript.Args {
+		witnessSize += witnessItemSize(len(arg))
+	}
+	witnessSize += witnessItemSize(len(u.TapScript.LeafScript)) + witnessItemSize(len(u.TapScript.ControlBlock))
+
+	return ForgeTxInSize{
+		Witness:        wire.VarIntSerializeSize(uint64(itemsCount)) + witnessSize,
+		SerializedSize: txInBaseSize,
+	}
+}
+
+// P2WSHMultiSigUnlocker spends P2WSH m-of-n multisig output, or P2SH-P2WSH one if Nested is set.
+// Witness is <empty> <sigs...> <witness script>, empty element is consumed by CHECKMULTISIG off-by-one bug
+type P2WSHMultiSigUnlocker struct {
+	WitnessScript []byte
+	// Signers are any m keys of WitnessScript in any order
+	Signers []Signer
+	Nested  bool
+}
+
+func (u *P2WSHMultiSigUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	signatures, err := multiSigSignatures(u.WitnessScript, func(pubKey []byte) ([]byte, error) {
+		signer, err := findSigner(u.Signers, pubKey)
+		if signer == nil || err != nil {
+			return nil, err
+		}
+		return signECDSA(ctx, signer, u.WitnessScript, true)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	witness := make(wire.TxWitness, 0, len(signatures)+2)
+	witness = append(witness, nil)
+	witness = append(witness, signatures...)
+	witness = append(witness, u.WitnessScript)
+
+	if !u.Nested {
+		return nil, witness, nil
+	}
+
+	// P2SH-P2WSH: scriptSig is a single push of the witness program
+	witnessScriptHash := sha256.Sum256(u.WitnessScript)
+	witnessProgram, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(witnessScriptHash[:]).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	signatureScript, err := txscript.NewScriptBuilder().AddData(witnessProgram).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signatureScript, witness, nil
+}
+
+func (u *P2WSHMultiSigUnlocker) Size() ForgeTxInSize {
+	numSigs := multiSigRequired(u.WitnessScript)
+	witnessSize := wire.VarIntSerializeSize(uint64(numSigs+2)) + 1 + numSigs*witnessItemSize(ecdsaSigSize(u.Signers...)) + witnessItemSize(len(u.WitnessScript))
+
+	serializedSize := txInBaseSize
+	if u.Nested {
+		serializedSize += pushDataSize(34)
+	}
+
+	return ForgeTxInSize{
+		Witness:        witnessSize,
+		SerializedSize: serializedSize,
+	}
+}
+
+// P2SHMultiSigUnlocker spends legacy P2SH m-of-n multisig output with OP_0 <sigs...> <redeem script> scriptSig
+type P2SHMultiSigUnlocker struct {
+	RedeemScript []byte
+	// Signers are any m keys of RedeemScript in any order
+	Signers []Signer
+}
+
+func (u *P2SHMultiSigUnlocker) Unlock(ctx *UnlockContext) ([]byte, wire.TxWitness, error) {
+	signatures, err := multiSigSignatures(u.RedeemScript, func(pubKey []byte) ([]byte, error) {
+		signer, err := findSigner(u.Signers, pubKey)
+		if signer == nil || err != nil {
+			return nil, err
+		}
+		return signECDSA(ctx, signer, u.RedeemScript, false)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	builder := txscript.NewScriptBuilder().AddOp(txscript.OP_0)
+	for _, signature := range signatures {
+		builder.AddData(signature)
+	}
+	signatureScript, err := builder.AddData(u.RedeemScript).Script()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signatureScript, nil, nil
+}
+
+func (u *P2SHMultiSigUnlocker) Size() ForgeTxInSize {
+	signatureScriptSize := 1 + multiSigRequired(u.RedeemScript)*pushDataSize(ecdsaSigSize(u.Signers...)) + pushDataSize(len(u.RedeemScript))
+
+	return ForgeTxInSize{
+		SerializedSize: txInBaseSize - 1 + wire.VarIntSerializeSize(uint64(signatureScriptSize)) + signatureScriptSize,
+	}
+}
+
+// errNotEnoughSignatures means there aren't keys or signatures to satisfy the script
+var errNotEnoughSignatures = errors.New("not enough signatures")
+
+// multiSigSignatures are the first m signatures of sign in order of pubkeys in CHECKMULTISIG script,
+// sign returns nil signature if it can't sign for pubKey
+func multiSigSignatures(multiSigScript []byte, sign func(pubKey []byte) ([]byte, error)) ([][]byte, error) {
+	isMultiSig, err := txscript.IsMultisigScript(multiSigScript)
+	if err != nil {
+		return nil, err
+	}
+	if !isMultiSig {
+		return nil, errors.New("script isn't m-of-n CHECKMULTISIG")
+	}
+
+	_, numSigs, err := txscript.CalcMultiSigStats(multiSigScript)
+	if err != nil {
+		return nil, err
+	}
+
+	// OP_m <pubkey>... OP_n OP_CHECKMULTISIG, the only pushes are pubkeys
+	pubKeys, err := txscript.PushedData(multiSigScript)
+	if err != nil {
+		return nil, err
+	}
+
+	signatures := make([][]byte, 0, numSigs)
+	for _, pubKey := range pubKeys {
+		if len(signatures) == numSigs {
+			break
+		}
+
+		signature, err := sign(pubKey)
+		if err != nil {
+			return nil, err
+		}
+		if signature != nil {
+			signatures = append(signatures, signature)
+		}
+	}
+
+	if len(signatures) < numSigs {
+		return nil, errors.Wrapf(errNotEnoughSignatures, "multisig %d of %d", len(signatures), numSigs)
+	}
+
+	return signatures, nil
+}
+
+// multiSigRequired is m of m-of-n CHECKMULTISIG script, 0 if script isn't a multisig one
+func multiSigRequired(multiSigScript []byte) int {
+	_, numSigs, err := txscript.CalcMultiSigStats(multiSigScript)
+	if err != nil {
+		return 0
+	}
+
+	return numSigs
+}
+
+// pushDataSize is size of the script pushing dataLen bytes
+func pushDataSize(dataLen int) int {
+	switch {
+	case dataLen < txscript.OP_PUSHDATA1:
+		return 1 + dataLen
+	case dataLen <= 0xff:
+		return 2 + dataLen
+	case dataLen <= 0xffff:
+		return 3 + dataLen
+	default:
+		return 5 + dataLen
+	}
+}
+
+// ecdsaSigSize is the longest signature of signers, the shorter one if all of them grind low R
+func ecdsaSigSize(signers ...Signer) int {
+	if len(signers) == 0 {
+		return maxECDSASigSize
+	}
+	for _, signer := range signers {
+		if wifSigner, ok := signer.(*WIFSigner); !ok || !wifSigner.LowR {
+			return maxECDSASigSize
+		}
+	}
+
+	return lowRECDSASigSize
+}
+
+// witnessItemSize is size of length prefixed witness stack element
+func witnessItemSize(itemLen int) int {
+	return wire.VarIntSerializeSize(uint64(itemLen)) + itemLen
+}
+
+// unlocker is ForgeTxIn.Unlocker, or a builtin one chosen by type of UTXO pkScript, in-memory keys grind low R if lowR is set
+func (txin *ForgeTxIn) unlocker(lowR bool) Unlocker {
+	if txin.Unlocker != nil {
+		return txin.Unlocker
+	}
+
+	signer, signers := txin.signer(lowR), txin.signers(lowR)
+	switch pkScript := txin.Utxo.PubKeyScript; {
+	case txscript.IsPayToPubKeyHash(pkScript):
+		return &P2PKHUnlocker{Signer: signer}
+	case txscript.IsPayToPubKey(pkScript):
+		return &P2PKUnlocker{Signer: signer}
+	case txscript.IsPayToScriptHash(pkScript) && txin.RedeemScript != nil:
+		return &P2SHMultiSigUnlocker{RedeemScript: txin.RedeemScript, Signers: signers}
+	case txscript.IsPayToWitnessScriptHash(pkScript):
+		return &P2WSHMultiSigUnlocker{WitnessScript: txin.WitnessScript, Signers: signers}
+	case txscript.IsPayToScriptHash(pkScript) && txin.WitnessScript != nil:
+		return &P2WSHMultiSigUnlocker{WitnessScript: txin.WitnessScript, Signers: signers, Nested: true}
+	case txscript.IsPayToTaproot(pkScript) && txin.TapScript != nil:
+		return &P2TRScriptUnlocker{Signer: signer, TapScript: txin.TapScript}
+	case txscript.IsPayToTaproot(pkScript):
+		return &P2TRUnlocker{Signer: signer, MerkleRoot: txin.TaprootMerkleRoot}
+	case txscript.IsPayToWitnessPubKeyHash(pkScript):
+		return &P2WPKHUnlocker{Signer: signer}
+	default:
+		return &P2SHP2WPKHUnlocker{Signer: signer}
+	}
+}
+
+// signer is Signer of the input, or in-memory one of WIFPrivKey, nil if there's neither
+func (txin *ForgeTxIn) signer(lowR bool) Signer {
+	switch {
+	case txin.Signer != nil:
+		return txin.Signer
+	case txin.WIFPrivKey != nil:
+		return &WIFSigner{WIF: txin.WIFPrivKey, LowR: lowR}
+	default:
+		return nil
+	}
+}
+
+// signers are Signers of multisig input, or in-memory ones of WIFPrivKeys
+func (txin *ForgeTxIn) signers(lowR bool) []Signer {
+	if txin.Signers != nil {
+		return txin.Signers
+	}
+
+	signers := make([]Signer, 0, len(txin.WIFPrivKeys))
+	for _, key := range txin.WIFPrivKeys {
+		signers = append(signers, &WIFSigner{WIF: key, LowR: lowR})
+	}
+
+	return signers
+}
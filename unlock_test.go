@@ -0,0 +1,142 @@
+package tx_forge
+
+import (
+	"crypto/sha256"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// opTrueUnlocker spends P2WSH of OP_TRUE script, it's the simplest custom Unlocker
+type opTrueUnlocker struct{}
+
+func (u *opTrueUnlocker) Unlock(*UnlockContext) ([]byte, wire.TxWitness, error) {
+	return nil, wire.TxWitness{{txscript.OP_TRUE}}, nil
+}
+
+func (u *opTrueUnlocker) Size() ForgeTxInSize {
+	return ForgeTxInSize{
+		Witness:        1 + witnessItemSize(1),
+		SerializedSize: txInBaseSize,
+	}
+}
+
+func TestUnlocker(t *testing.T) {
+	testParams := &Params{
+		FeeRate:    DefaultFeeRate,
+		Network:    &chaincfg.TestNet3Params,
+		NeedToSign: true,
+	}
+
+	wifPrivateKey1, wifPrivateKey2, wifPrivateKey3 := generateTestKeys(t)
+
+	payToAddr := payToAddrOf(t)
+
+	pubKey1 := wifPrivateKey1.SerializePubKey()
+	multiSigScript := generateMultiSigScript(t, 2, wifPrivateKey1, wifPrivateKey2, wifPrivateKey3)
+	multiSigScriptHash := sha256.Sum256(multiSigScript)
+	pkScriptP2WSH := payToAddr(btcutil.NewAddressWitnessScriptHash(multiSigScriptHash[:], testParams.Network))
+
+	tapTree := generateTapTree(t, wifPrivateKey1, wifPrivateKey2, testParams.Network)
+
+	opTrueScriptHash := sha256.Sum256([]byte{txscript.OP_TRUE})
+
+	t.Run("builtin and custom unlockers", func(t *testing.T) {
+		testcases := []struct {
+			name     string
+			pkScript []byte
+			unlocker Unlocker
+		}{
+			{
+				name:     "p2pkh",
+				pkScript: payToAddr(btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey1), testParams.Network)),
+				unlocker: &P2PKHUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey1}},
+			},
+			{
+				name:     "p2pk",
+				pkScript: payToAddr(btcutil.NewAddressPubKey(pubKey1, testParams.Network)),
+				unlocker: &P2PKUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey1}},
+			},
+			{
+				name:     "p2wpkh",
+				pkScript: generateP2WPKHPkScript(t, wifPrivateKey1, testParams.Network),
+				unlocker: &P2WPKHUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey1}},
+			},
+			{
+				name:     "p2sh-p2wpkh",
+				pkScript: payToAddr(btcutil.DecodeAddress(p2sh1, testParams.Network)),
+				unlocker: &P2SHP2WPKHUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey1}},
+			},
+			{
+				name:     "p2tr key-path",
+				pkScript: payToAddr(btcutil.NewAddressTaproot(schnorr.SerializePubKey(txscript.ComputeTaprootKeyNoScript(wifPrivateKey1.PrivKey.PubKey())), testParams.Network)),
+				unlocker: &P2TRUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey1}},
+			},
+			{
+				name:     "p2tr key-path with script tree",
+				pkScript: tapTree.PkScript,
+				unlocker: &P2TRUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey1}, MerkleRoot: tapTree.MerkleRoot},
+			},
+			{
+				name:     "p2tr script-path",
+				pkScript: tapTree.PkScript,
+				unlocker: &P2TRScriptUnlocker{Signer: &WIFSigner{WIF: wifPrivateKey2}, TapScript: &TapScriptSpend{LeafScript: tapTree.LeafScript, ControlBlock: tapTree.ControlBlock}},
+			},
+			{
+				name:     "p2wsh multisig",
+				pkScript: pkScriptP2WSH,
+				unlocker: &P2WSHMultiSigUnlocker{WitnessScript: multiSigScript, Signers: WIFSigners(wifPrivateKey1, wifPrivateKey2)},
+			},
+			{
+				name:     "p2sh-p2wsh multisig",
+				pkScript: payToAddr(btcutil.NewAddressScriptHash(pkScriptP2WSH, testParams.Network)),
+				unlocker: &P2WSHMultiSigUnlocker{WitnessScript: multiSigScript, Signers: WIFSigners(wifPrivateKey2, wifPrivateKey3), Nested: true},
+			},
+			{
+				name:     "p2sh multisig",
+				pkScript: payToAddr(btcutil.NewAddressScriptHash(multiSigScript, testParams.Network)),
+				unlocker: &P2SHMultiSigUnlocker{RedeemScript: multiSigScript, Signers: WIFSigners(wifPrivateKey1, wifPrivateKey3)},
+			},
+			{
+				name:     "custom",
+				pkScript: payToAddr(btcutil.NewAddressWitnessScriptHash(opTrueScriptHash[:], testParams.Network)),
+				unlocker: &opTrueUnlocker{},
+			},
+		}
+		for _, tc := range testcases {
+			t.Run(tc.name, func(t *testing.T) {
+				txIn := generateTxIn(prevTxId1, 0, 10000, tc.pkScript, nil)
+				txIn.Unlocker = tc.unlocker
+
+				redeemTx, _, err := ForgeTx([]ForgeTxIn{txIn}, []ForgeTxOut{{Value: 10000, Address: p2sh1}}, testParams)
+				require.NoError(t, err)
+				require.Len(t, redeemTx.TxIn, 1)
+
+				witnessSize := 0
+				if len(redeemTx.TxIn[0].Witness) > 0 {
+					witnessSize = redeemTx.TxIn[0].Witness.SerializeSize()
+				}
+
+				// size is the worst case, signatures may be a byte shorter, scriptSig length prefix may be shorter with them
+				size := tc.unlocker.Size()
+				assert.LessOrEqual(t, redeemTx.TxIn[0].SerializeSize(), size.SerializedSize)
+				assert.LessOrEqual(t, witnessSize, size.Witness)
+				assert.InDelta(t, redeemTx.TxIn[0].SerializeSize(), size.SerializedSize, 4)
+				assert.InDelta(t, witnessSize, size.Witness, 2)
+			})
+		}
+	})
+
+	t.Run("unlocker error is returned", func(t *testing.T) {
+		txIn := generateTxIn(prevTxId1, 0, 10000, pkScriptP2WSH, nil)
+		txIn.Unlocker = &P2WSHMultiSigUnlocker{WitnessScript: multiSigScript, Signers: WIFSigners(wifPrivateKey1)}
+
+		_, _, err := ForgeTx([]ForgeTxIn{txIn}, []ForgeTxOut{{Value: 10000, Address: p2sh1}}, testParams)
+		require.Error(t, err)
+	})
+}